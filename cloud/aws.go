@@ -1,34 +1,28 @@
 package cloud
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"time"
 
 	"fmt"
 
-	"sync"
-
 	"regexp"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"github.com/dustin/go-humanize"
-	"github.com/iandri/snowball/utils"
 	"github.com/pkg/errors"
-	"gopkg.in/cheggaaa/pb.v1"
 )
 
-type Uploader struct {
-	Location string
-	Size     int64
-	Elapsed  time.Duration
-}
-
 func ListObjects(s3SVC *s3.S3, bucket, prefix string) (*s3.ListObjectsOutput, error) {
 	input := &s3.ListObjectsInput{
 		Bucket: aws.String(bucket),
@@ -70,6 +64,56 @@ func ListObjectsAll(s3SVC *s3.S3, bucket string, prefix string) ([]*s3.Object, e
 	return objects, err
 }
 
+// WalkObjects streams the listing of every object under prefix to fn, one
+// page at a time. Returning false from fn stops the listing.
+func WalkObjects(s3SVC *s3.S3, bucket, prefix string, fn func(*s3.Object) bool) error {
+	input := &s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	stop := false
+	err := s3SVC.ListObjectsPages(input, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		for _, v := range page.Contents {
+			if !fn(v) {
+				stop = true
+				return false
+			}
+		}
+		return !lastPage && !stop
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func HeadObject(s3SVC *s3.S3, bucket, key string) (*s3.HeadObjectOutput, error) {
+	head, err := s3SVC.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return head, nil
+}
+
+// Metadata looks up a user metadata value, whose key S3 returns in
+// canonical header form.
+func Metadata(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// MaxDeleteKeys is the most keys a single DeleteObjects request accepts.
+const MaxDeleteKeys = 1000
+
+// DeleteObjects deletes keys and, when prefix is set, the objects matching
+// it. The keys are sent in batches of MaxDeleteKeys and the outputs merged.
 func DeleteObjects(s3SVC *s3.S3, bucket string, keys []string, prefix string) (*s3.DeleteObjectsOutput, error) {
 	if prefix != "" {
 		objs, err := ListObjectsAll(s3SVC, bucket, prefix)
@@ -81,146 +125,114 @@ func DeleteObjects(s3SVC *s3.S3, bucket string, keys []string, prefix string) (*
 			keys = append(keys, *v.Key)
 		}
 	}
-	objects := make([]*s3.ObjectIdentifier, len(keys))
-	for _, v := range keys {
-		objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(v)})
-	}
-	input := &s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
-		Delete: &s3.Delete{
-			Objects: objects,
-			Quiet:   aws.Bool(false),
-		},
-	}
 
-	result, err := s3SVC.DeleteObjects(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			default:
-				return &s3.DeleteObjectsOutput{}, aerr
+	output := &s3.DeleteObjectsOutput{}
+	for start := 0; start < len(keys); start += MaxDeleteKeys {
+		end := start + MaxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, v := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(v)})
+		}
+		input := &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{
+				Objects: objects,
+				Quiet:   aws.Bool(false),
+			},
+		}
+
+		result, err := s3SVC.DeleteObjects(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok {
+				switch aerr.Code() {
+				default:
+					return output, aerr
+				}
+			} else {
+				return output, err
 			}
-		} else {
-			return &s3.DeleteObjectsOutput{}, err
 		}
+		output.Deleted = append(output.Deleted, result.Deleted...)
+		output.Errors = append(output.Errors, result.Errors...)
 	}
-	return result, nil
+	return output, nil
 }
 
-func UploadObject(s3SVC *s3.S3, bucket string, partSize int64, threads int, src, dst string) (*Uploader, error) {
-	uploadResult := new(Uploader)
-	uploader := s3manager.NewUploaderWithClient(s3SVC, func(u *s3manager.Uploader) {
-		u.PartSize = partSize * 1024 * 1024
-		u.Concurrency = threads
-		u.LeavePartsOnError = true
-	})
-
+// putObject uploads a file smaller than a part in a single request. With
+// full checksums the body is read once to compute its MD5, sent as
+// Content-MD5 and checked against the returned ETag, and its SHA-256,
+// stored as metadata.
+func (t *transfer) putObject(bucket, src, dst string) (*Result, error) {
 	file, err := os.Open(src)
 	if err != nil {
-		return uploadResult, err
+		return t.result, errors.WithStack(err)
 	}
 	defer file.Close()
-
-	fi, err := file.Stat()
-	if err != nil {
-		log.Print("could not get file size, ", errors.WithStack(err))
-		return uploadResult, err
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(dst),
+		StorageClass: t.storageClass(),
+		Metadata:     t.metadata(nil),
 	}
-	totalSize := fi.Size()
-
-	start := time.Now().UTC()
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Body:                 bufio.NewReader(file),
-		Bucket:               aws.String(bucket),
-		Key:                  aws.String(dst),
-		ServerSideEncryption: aws.String("false"),
-	})
-	if err != nil {
-		//log.Fatal(errors.WithStack(err))
-		if multierr, ok := err.(s3manager.MultiUploadFailure); ok {
-			// Process error and its associated uploadID
-			log.Println("Error:", multierr.Code(), multierr.Message(), multierr.UploadID())
-			return uploadResult, err
-		} else if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			// If the SDK can determine the request or retry delay was canceled
-			// by a context the CanceledErrorCode error code will be returned.
-			log.Printf("upload canceled due to timeout, %v\n", err)
-			return uploadResult, err
-		} else {
-			// Process error generically
-			return uploadResult, err
+	var body io.ReadSeeker = file
+	var size int64
+	var localETag string
+	if t.checked() {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return t.result, errors.WithStack(err)
 		}
+		md5sum := md5.Sum(data)
+		shasum := sha256.Sum256(data)
+		localETag = hex.EncodeToString(md5sum[:])
+		t.result.SHA256 = hex.EncodeToString(shasum[:])
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(md5sum[:]))
+		input.Metadata[SHA256Key] = aws.String(t.result.SHA256)
+		body = bytes.NewReader(data)
+		size = int64(len(data))
+	} else {
+		fi, err := file.Stat()
+		if err != nil {
+			return t.result, errors.WithStack(err)
+		}
+		size = fi.Size()
 	}
-	elapsed := time.Since(start)
-
-	uploadResult.Location = result.Location
-
-	uploadResult.Size = totalSize
-	uploadResult.Elapsed = elapsed
-	return uploadResult, nil
-}
-
-func MultiUploadObject(pb *pb.ProgressBar, wg *sync.WaitGroup, s3SVC *s3.S3, bucket string, partSize int64, threads int, src, dst string) (*Uploader, error) {
-	defer func() {
-		wg.Done()
-		pb.Increment()
-	}()
-	uploadResult := new(Uploader)
-	uploader := s3manager.NewUploaderWithClient(s3SVC, func(u *s3manager.Uploader) {
-		u.PartSize = partSize * 1024 * 1024
-		u.Concurrency = threads
-		u.LeavePartsOnError = true
-	})
-
-	file, err := os.Open(src)
-	if err != nil {
-		return uploadResult, err
-	}
-	defer file.Close()
-
-	fi, err := file.Stat()
-	if err != nil {
-		log.Print("could not get file size, ", errors.WithStack(err))
-		return uploadResult, err
+	if input.Body, err = newProgressReader(body, t.progress()); err != nil {
+		return t.result, errors.WithStack(err)
 	}
-	totalSize := fi.Size()
 
-	start := time.Now().UTC()
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Body:                 bufio.NewReader(file),
-		Bucket:               aws.String(bucket),
-		Key:                  aws.String(dst),
-		ServerSideEncryption: aws.String("false"),
-	})
+	result, err := t.S3.PutObjectWithContext(aws.BackgroundContext(), input, t.request)
 	if err != nil {
-		if multierr, ok := err.(s3manager.MultiUploadFailure); ok {
-			// Process error and its associated uploadID
-			log.Println("Error:", multierr.Code(), multierr.Message(), multierr.UploadID())
-			return uploadResult, err
-		} else if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
 			// If the SDK can determine the request or retry delay was canceled
 			// by a context the CanceledErrorCode error code will be returned.
-			log.Printf("upload canceled due to timeout, %v\n", err)
-			return uploadResult, err
-		} else {
-			// Process error generically
-			return uploadResult, err
+			log.Printf("upload canceled, %v\n", err)
 		}
+		return t.result, err
 	}
-	elapsed := time.Since(start)
-
-	uploadResult.Location = result.Location
-
-	uploadResult.Size = totalSize
-	uploadResult.Elapsed = elapsed
-	return uploadResult, nil
+	t.result.ETag = aws.StringValue(result.ETag)
+	if t.checked() && !SameETag(localETag, t.result.ETag) {
+		return t.result, &ChecksumError{Key: dst, Local: localETag, Remote: t.result.ETag}
+	}
+	return t.done(size), nil
 }
 
-func (u Uploader) String() string {
-	size := humanize.Bytes(uint64(u.Size))
-	seconds := u.Elapsed.Seconds()
-	elapsed := utils.HumanizeDuration(u.Elapsed)
-	bandwidth := float64(u.Size) / seconds / 1024.0 / 1024.0
-	return fmt.Sprintf("Location     : %s\nSize         : %s\nElapsed time : %s\nBandwidth    :% 4.0f MBytes/sec\n",
-		u.Location, size, elapsed, bandwidth)
+// putMarker uploads the empty object key holding only metadata, which
+// stands for a directory or a symlink.
+func (t *transfer) putMarker(bucket, key string) (*Result, error) {
+	result, err := t.S3.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
+		Body:         bytes.NewReader(nil),
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		StorageClass: t.storageClass(),
+		Metadata:     t.metadata(nil),
+	}, t.request)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	t.result.ETag = aws.StringValue(result.ETag)
+	return t.done(0), nil
 }
@@ -0,0 +1,70 @@
+package cloud
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// AutoExtractKey is the metadata asking the device to unpack a tar object
+// into the objects it contains on import.
+const AutoExtractKey = "snowball-auto-extract"
+
+// writeTar streams srcs into a tar archive, each file stored under the
+// matching name of names. The bytes read from srcs are reported to progress.
+func writeTar(w io.Writer, srcs, names []string, progress Progress) (int64, error) {
+	tw := tar.NewWriter(w)
+	var total int64
+	for i, src := range srcs {
+		file, err := os.Open(src)
+		if err != nil {
+			return total, errors.WithStack(err)
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return total, errors.WithStack(err)
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			file.Close()
+			return total, errors.WithStack(err)
+		}
+		hdr.Name = names[i]
+		if err := tw.WriteHeader(hdr); err != nil {
+			file.Close()
+			return total, errors.WithStack(err)
+		}
+		n, err := io.CopyN(tw, countingReader{file, progress}, hdr.Size)
+		file.Close()
+		total += n
+		if err != nil {
+			return total, errors.Wrapf(err, "%s changed while batching", src)
+		}
+	}
+	return total, errors.WithStack(tw.Close())
+}
+
+// uploadBatch streams the tar of srcs to dst while it is built, checked
+// like any stream. The size of the result is the one of the files batched.
+func (t *transfer) uploadBatch(bucket string, srcs, names []string, dst string) (*Result, error) {
+	pr, pw := io.Pipe()
+	var totalSize int64
+	go func() {
+		var err error
+		totalSize, err = writeTar(pw, srcs, names, t.progress())
+		pw.CloseWithError(err)
+	}()
+
+	result, err := t.streamUpload(bucket, pr, dst, map[string]*string{AutoExtractKey: aws.String("true")})
+	// unblock the tar writer if the upload stopped reading
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return result, errors.Wrapf(err, "batch %s", dst)
+	}
+	result.Size = totalSize
+	return result, nil
+}
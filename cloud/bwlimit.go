@@ -0,0 +1,246 @@
+package cloud
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest amount of bytes a transfer may send at once.
+const minBurst = 32 * 1024
+
+// Limiter is a token bucket of bytes per second. A zero rate is unlimited.
+// A paused Limiter lets the transfers in flight finish but holds new ones.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    int64
+	tokens  float64
+	last    time.Time
+	paused  bool
+	resumed chan struct{}
+}
+
+// Bandwidth limits the traffic of every request sent with LimitTransport,
+// uploads and downloads alike.
+var Bandwidth = &Limiter{}
+
+// SetPaused pauses or resumes l.
+func (l *Limiter) SetPaused(paused bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if paused && !l.paused {
+		l.resumed = make(chan struct{})
+	} else if !paused && l.paused {
+		close(l.resumed)
+	}
+	l.paused = paused
+}
+
+// Paused reports whether l is paused.
+func (l *Limiter) Paused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// Hold blocks while l is paused, until the transfers are canceled.
+func (l *Limiter) Hold() {
+	l.mu.Lock()
+	for l.paused {
+		resumed := l.resumed
+		l.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-canceled.Done():
+			return
+		}
+		l.mu.Lock()
+	}
+	l.mu.Unlock()
+}
+
+// SetRate changes the rate of l, taking effect for the transfers already
+// waiting on it.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// Rate returns the current rate of l in bytes per second.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *Limiter) burst() int {
+	if b := int(l.rate / 8); b > minBurst {
+		return b
+	}
+	return minBurst
+}
+
+// chunk returns how many bytes a reader may take from l at once.
+func (l *Limiter) chunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	return l.burst()
+}
+
+// wait blocks until n bytes, at most chunk(), may be sent or the transfers
+// are canceled. It wakes up at least every 100ms to follow rate changes.
+func (l *Limiter) wait(n int) {
+	for {
+		l.mu.Lock()
+		if l.rate <= 0 || Canceled() {
+			l.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		l.last = now
+		if burst := float64(l.burst()); l.tokens > burst {
+			l.tokens = burst
+		}
+		if l.tokens >= float64(n) {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return
+		}
+		sleep := time.Duration((float64(n) - l.tokens) / float64(l.rate) * float64(time.Second))
+		l.mu.Unlock()
+		if sleep > 100*time.Millisecond {
+			sleep = 100 * time.Millisecond
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// limitedBody reads through a Limiter.
+type limitedBody struct {
+	io.ReadCloser
+	l *Limiter
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if chunk := b.l.chunk(); chunk > 0 && len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.l.wait(n)
+	}
+	return n, err
+}
+
+type limitedTransport struct {
+	rt http.RoundTripper
+	l  *Limiter
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &limitedBody{req.Body, t.l}
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err == nil && resp.Body != nil {
+		resp.Body = &limitedBody{resp.Body, t.l}
+	}
+	return resp, err
+}
+
+// LimitTransport makes rt send request bodies and read response bodies
+// within Bandwidth.
+func LimitTransport(rt http.RoundTripper) http.RoundTripper {
+	return &limitedTransport{rt: rt, l: Bandwidth}
+}
+
+// ParseRate parses a rate such as "200MB/s", "512k" or "1.5G" into bytes per
+// second, with units in powers of 1024 as in ParseSize. An empty string,
+// "0", "off" and "unlimited" are unlimited.
+func ParseRate(s string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	if text == "UNLIMITED" {
+		return 0, nil
+	}
+	text = strings.TrimSuffix(text, "/S")
+	if text == "" || text == "0" || text == "B" || text == "OFF" {
+		return 0, nil
+	}
+	return parseBytes(text, s, "rate")
+}
+
+// ParseSize parses a size such as "10KB", "512k", "4GiB" or "1.5G" into
+// bytes. The K, M and G units are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	return parseBytes(strings.ToUpper(strings.TrimSpace(s)), s, "size")
+}
+
+// parseBytes parses text, the upper cased s, into bytes, what naming s in
+// the errors.
+func parseBytes(text, s, what string) (int64, error) {
+	if strings.HasSuffix(text, "IB") {
+		text = strings.TrimSuffix(text, "IB")
+	} else {
+		text = strings.TrimSuffix(text, "B")
+	}
+	if text == "" {
+		return 0, fmt.Errorf("invalid %s %q", what, s)
+	}
+	unit := int64(1)
+	switch text[len(text)-1] {
+	case 'K':
+		unit = 1024
+	case 'M':
+		unit = 1024 * 1024
+	case 'G':
+		unit = 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		text = text[:len(text)-1]
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || !(value >= 0) || math.IsInf(value, 1) {
+		return 0, fmt.Errorf("invalid %s %q", what, s)
+	}
+	// float64(math.MaxInt64) is 2^63, one more than the largest int64
+	if value*float64(unit) >= float64(math.MaxInt64) {
+		return 0, fmt.Errorf("%s %q too large", what, s)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// ParseLimit parses a rate like ParseRate, or "paused".
+func ParseLimit(s string) (int64, bool, error) {
+	if strings.EqualFold(strings.TrimSpace(s), "paused") {
+		return 0, true, nil
+	}
+	rate, err := ParseRate(s)
+	return rate, false, err
+}
+
+// FormatRate is the reverse of ParseRate.
+func FormatRate(rate int64) string {
+	switch {
+	case rate <= 0:
+		return "unlimited"
+	case rate >= 1024*1024*1024:
+		return fmt.Sprintf("%.1fGB/s", float64(rate)/(1024*1024*1024))
+	case rate >= 1024*1024:
+		return fmt.Sprintf("%.1fMB/s", float64(rate)/(1024*1024))
+	case rate >= 1024:
+		return fmt.Sprintf("%.1fKB/s", float64(rate)/1024)
+	}
+	return fmt.Sprintf("%dB/s", rate)
+}
@@ -0,0 +1,103 @@
+package cloud
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"off", 0, false},
+		{"Unlimited", 0, false},
+		{"100", 100, false},
+		{"100B/s", 100, false},
+		{"512k", 512 * 1024, false},
+		{"512KB/s", 512 * 1024, false},
+		{"200MB/s", 200 * 1024 * 1024, false},
+		{" 1.5G ", 1536 * 1024 * 1024, false},
+		{"K", 0, true},
+		{"-1M", 0, true},
+		{"fast", 0, true},
+		{"10T", 0, true},
+		{"nan", 0, true},
+		{"inf", 0, true},
+		{"8589934591G", 8589934591 * 1024 * 1024 * 1024, false},
+		{"8589934592G", 0, true},
+		{"1e300", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseRate(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"1", 1, false},
+		{"10KB", 10 * 1024, false},
+		{"10k", 10 * 1024, false},
+		{"4GiB", 4 * 1024 * 1024 * 1024, false},
+		{" 1.5M ", 1536 * 1024, false},
+		{"", 0, true},
+		{"B", 0, true},
+		{"-1", 0, true},
+		{"10 apples", 0, true},
+		{"8589934592G", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseSize(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	if rate, paused, err := ParseLimit(" Paused"); err != nil || !paused || rate != 0 {
+		t.Errorf("ParseLimit(paused) = %d, %v, %v", rate, paused, err)
+	}
+	if rate, paused, err := ParseLimit("1M"); err != nil || paused || rate != 1024*1024 {
+		t.Errorf("ParseLimit(1M) = %d, %v, %v", rate, paused, err)
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		rate int64
+		want string
+	}{
+		{0, "unlimited"},
+		{512, "512B/s"},
+		{1536, "1.5KB/s"},
+		{200 * 1024 * 1024, "200.0MB/s"},
+		{2 * 1024 * 1024 * 1024, "2.0GB/s"},
+	}
+	for _, tt := range tests {
+		if got := FormatRate(tt.rate); got != tt.want {
+			t.Errorf("FormatRate(%d) = %s, want %s", tt.rate, got, tt.want)
+		}
+		if tt.rate > 0 && tt.rate%1024 == 0 {
+			if back, err := ParseRate(FormatRate(tt.rate)); err != nil || back != tt.rate {
+				t.Errorf("ParseRate(FormatRate(%d)) = %d, %v", tt.rate, back, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package cloud
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// canceled is done once Cancel is called.
+var canceled, cancel = context.WithCancel(context.Background())
+
+// Cancel stops the transfers in flight: their requests fail with
+// request.CanceledErrorCode and the ones held by Bandwidth are let go.
+// Multipart uploads are left for resuming, or aborted when they can't be.
+func Cancel() {
+	cancel()
+}
+
+// Canceled reports whether Cancel was called.
+func Canceled() bool {
+	return canceled.Err() != nil
+}
+
+// CancelRequest is a Build handler tying the requests of a client to
+// Cancel. The requests aborting a multipart upload are left out, so the
+// uploads canceled can still be cleaned up.
+func CancelRequest(r *request.Request) {
+	if r.Operation.Name == "AbortMultipartUpload" {
+		return
+	}
+	r.SetContext(canceled)
+}
@@ -0,0 +1,110 @@
+package cloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Compression codecs and the metadata recording how an object was stored.
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+
+	CodecKey        = "snowball-codec"
+	OriginalSizeKey = "snowball-original-size"
+)
+
+var compressedExts = map[string]bool{
+	".gz": true, ".tgz": true, ".zst": true, ".bz2": true, ".xz": true,
+	".zip": true, ".7z": true, ".lz4": true,
+}
+
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'P', 'K', 0x03, 0x04},             // zip
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+}
+
+// CheckCodec validates a --compress value, empty meaning no compression.
+func CheckCodec(codec string) error {
+	switch codec {
+	case "", CodecGzip, CodecZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q, expected %s or %s", codec, CodecGzip, CodecZstd)
+}
+
+// Compressed reports whether src is already compressed, by its extension
+// or its first bytes, so compressing it again would only cost time.
+func Compressed(src string) (bool, error) {
+	if compressedExts[strings.ToLower(filepath.Ext(src))] {
+		return true, nil
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer file.Close()
+	head := make([]byte, 8)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, errors.WithStack(err)
+	}
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head[:n], magic) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func compressor(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, CheckCodec(codec)
+}
+
+// Decompressor wraps r, the content of an object stored with codec.
+func Decompressor(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return ioutil.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, CheckCodec(codec)
+}
+
+// OriginalSize returns the size of an object before compression or
+// encryption, from its metadata, or -1 when it was stored as is.
+func OriginalSize(metadata map[string]*string) int64 {
+	size, err := strconv.ParseInt(Metadata(metadata, OriginalSizeKey), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
@@ -0,0 +1,97 @@
+package cloud
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	inputs := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"text", bytes.Repeat([]byte("snowball "), 10000)},
+		{"random", randomBytes(3*mb + 100)},
+	}
+	for _, codec := range []string{CodecGzip, CodecZstd} {
+		for _, in := range inputs {
+			var stored bytes.Buffer
+			w, err := compressor(codec, &stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(in.data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := Decompressor(codec, &stored)
+			if err != nil {
+				t.Fatalf("%s %s: %v", codec, in.name, err)
+			}
+			got, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil || !bytes.Equal(got, in.data) {
+				t.Errorf("%s %s: %d bytes read back, want %d: %v", codec, in.name, len(got), len(in.data), err)
+			}
+		}
+	}
+	if _, err := compressor("lzma", ioutil.Discard); err == nil {
+		t.Error("unknown codec accepted")
+	}
+}
+
+func TestCompressedUploadRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("snowball "), 100000)
+	tests := []struct {
+		name  string
+		file  string
+		codec string
+		// stored is the codec the object is stored with
+		stored string
+	}{
+		{"gzip", "a.txt", CodecGzip, CodecGzip},
+		{"zstd", "a.txt", CodecZstd, CodecZstd},
+		{"already compressed", "a.gz", CodecZstd, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv := testEngine(t)
+			dir := t.TempDir()
+			src := writeFile(t, dir, tt.file, text)
+			opts := Options{PartSize: 5, Concurrency: 2, StateDir: dir, Encoding: Encoding{Codec: tt.codec}}
+			if _, err := e.Upload(testBucket, src, "dst", opts); err != nil {
+				t.Fatal(err)
+			}
+			obj := srv.Object(testBucket, "dst")
+			if obj == nil {
+				t.Fatal("no object stored")
+			}
+			if codec := obj.Metadata[http.CanonicalHeaderKey(CodecKey)]; codec != tt.stored {
+				t.Errorf("stored with codec %q, want %q", codec, tt.stored)
+			}
+			if tt.stored != "" {
+				if len(obj.Data) >= len(text) {
+					t.Errorf("%d bytes stored for %d compressed", len(obj.Data), len(text))
+				}
+				if size := obj.Metadata[http.CanonicalHeaderKey(OriginalSizeKey)]; size != strconv.Itoa(len(text)) {
+					t.Errorf("original size %q, want %d", size, len(text))
+				}
+			}
+
+			dst := filepath.Join(dir, "dst")
+			if _, err := e.Download(testBucket, "dst", dst, opts); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, text) {
+				t.Errorf("downloaded file differs: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package cloud
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// maxCopyObject is the largest object a single CopyObject request copies.
+const maxCopyObject = 5 * 1024 * 1024 * 1024
+
+// copySource is the x-amz-copy-source of key in bucket, every segment of
+// the key escaped on its own so its slashes are kept.
+func copySource(bucket, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return url.PathEscape(bucket) + "/" + strings.Join(segments, "/")
+}
+
+// Copy copies the object srcKey of srcBucket to dst in bucket, on the
+// device, with its metadata: in a single request when it is smaller than a
+// part, else in parts copied Concurrency at a time. The bytes copied are
+// reported to progress.
+func (e *Engine) Copy(srcBucket, srcKey, bucket, dst string, opts Options) (*Result, error) {
+	t := e.newTransfer(fmt.Sprintf("%s/%s/%s", e.S3.Endpoint, bucket, dst), opts)
+	head, err := HeadObject(t.S3, srcBucket, srcKey)
+	if err != nil {
+		return t.result, err
+	}
+	size := aws.Int64Value(head.ContentLength)
+	t.result.SHA256 = Metadata(head.Metadata, SHA256Key)
+	if size < t.partBytes() && size <= maxCopyObject {
+		return t.copyObject(srcBucket, srcKey, bucket, dst, size)
+	}
+	return t.copyParts(srcBucket, srcKey, bucket, dst, head)
+}
+
+func (t *transfer) copyObject(srcBucket, srcKey, bucket, dst string, size int64) (*Result, error) {
+	out, err := t.S3.CopyObjectWithContext(aws.BackgroundContext(), &s3.CopyObjectInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(dst),
+		CopySource:   aws.String(copySource(srcBucket, srcKey)),
+		StorageClass: t.storageClass(),
+	}, t.request)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	if out.CopyObjectResult != nil {
+		t.result.ETag = aws.StringValue(out.CopyObjectResult.ETag)
+	}
+	t.result.Parts = 1
+	t.progress().add(size)
+	return t.done(size), nil
+}
+
+// copyParts copies an object in a multipart upload of UploadPartCopy
+// requests, aborted if one of them fails.
+func (t *transfer) copyParts(srcBucket, srcKey, bucket, dst string, head *s3.HeadObjectOutput) (*Result, error) {
+	size := aws.Int64Value(head.ContentLength)
+	partBytes := t.partBytes()
+	numParts := (size + partBytes - 1) / partBytes
+	if numParts > s3manager.MaxUploadParts {
+		return t.result, fmt.Errorf("%s is too large to copy in parts of %d MB", srcKey, t.opts.PartSize)
+	}
+	out, err := t.S3.CreateMultipartUploadWithContext(aws.BackgroundContext(), &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(dst),
+		StorageClass: t.storageClass(),
+		ContentType:  head.ContentType,
+		Metadata:     head.Metadata,
+	}, t.request)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	uploadID := aws.StringValue(out.UploadId)
+
+	numbers := make(chan int64)
+	errs := make(chan error, t.opts.Concurrency)
+	var mu sync.Mutex
+	var completed []*s3.CompletedPart
+	var wg sync.WaitGroup
+	for i := 0; i < t.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for num := range numbers {
+				start := (num - 1) * partBytes
+				end := start + partBytes
+				if end > size {
+					end = size
+				}
+				out, err := t.S3.UploadPartCopyWithContext(aws.BackgroundContext(), &s3.UploadPartCopyInput{
+					Bucket:          aws.String(bucket),
+					Key:             aws.String(dst),
+					UploadId:        aws.String(uploadID),
+					PartNumber:      aws.Int64(num),
+					CopySource:      aws.String(copySource(srcBucket, srcKey)),
+					CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1)),
+				}, t.request)
+				if err != nil {
+					errs <- errors.Wrapf(err, "part %d of %s", num, srcKey)
+					return
+				}
+				mu.Lock()
+				completed = append(completed, &s3.CompletedPart{
+					ETag:       out.CopyPartResult.ETag,
+					PartNumber: aws.Int64(num),
+				})
+				mu.Unlock()
+				t.progress().add(end - start)
+				t.part(num, end-start)
+			}
+		}()
+	}
+
+	var copyErr error
+	for num := int64(1); num <= numParts && copyErr == nil; num++ {
+		select {
+		case numbers <- num:
+		case copyErr = <-errs:
+		}
+	}
+	close(numbers)
+	wg.Wait()
+	if copyErr == nil && len(errs) > 0 {
+		copyErr = <-errs
+	}
+	if copyErr != nil {
+		if err := AbortMultipartUpload(t.S3, bucket, dst, uploadID); err != nil {
+			log.Println(err)
+		}
+		return t.result, copyErr
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+	result, err := t.S3.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(dst),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	}, t.request)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	t.result.ETag = aws.StringValue(result.ETag)
+	t.result.Parts = numParts
+	return t.done(size), nil
+}
@@ -0,0 +1,63 @@
+package cloud
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCopySource(t *testing.T) {
+	tests := []struct {
+		bucket, key, want string
+	}{
+		{"test", "a", "test/a"},
+		{"test", "dir/sub/a", "test/dir/sub/a"},
+		{"test", "a b/c%d?e", "test/a%20b/c%25d%3Fe"},
+		{"test", "dir//a", "test/dir//a"},
+	}
+	for _, tt := range tests {
+		if got := copySource(tt.bucket, tt.key); got != tt.want {
+			t.Errorf("copySource(%q, %q) = %q, want %q", tt.bucket, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		parts int64
+	}{
+		{"single request", 100, 1},
+		{"parts", 2*mb + 100, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv := testEngine(t)
+			data := randomBytes(tt.size)
+			src := "dir with spaces/a+b%c?.txt"
+			srv.PutObject(testBucket, src, data, map[string]string{SHA256Key: "sum"})
+			dst := "copies/" + src
+			res, err := e.Copy(testBucket, src, testBucket, dst, Options{PartSize: 1, Concurrency: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Parts != tt.parts || res.Size != int64(tt.size) {
+				t.Errorf("copied %d bytes in %d parts, want %d in %d", res.Size, res.Parts, tt.size, tt.parts)
+			}
+			o := srv.Object(testBucket, dst)
+			if o == nil {
+				t.Fatalf("%s not copied, keys %v", dst, srv.Keys(testBucket))
+			}
+			if !bytes.Equal(o.Data, data) {
+				t.Error("copy differs from the source")
+			}
+			head, err := HeadObject(srv.Client(), testBucket, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Metadata(head.Metadata, SHA256Key); got != "sum" {
+				t.Errorf("copy metadata %s = %q, want the source one", SHA256Key, got)
+			}
+		})
+	}
+}
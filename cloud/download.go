@@ -0,0 +1,406 @@
+package cloud
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// PartSuffix is appended to the destination of a download until it is
+// complete, so an interrupted download can be resumed.
+const PartSuffix = ".part"
+
+// sequentialWriter lets a single threaded download write to a stream.
+type sequentialWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (s *sequentialWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off != s.pos {
+		return 0, fmt.Errorf("out of order write at %d, expected %d", off, s.pos)
+	}
+	n, err := s.w.Write(p)
+	s.pos += int64(n)
+	return n, err
+}
+
+// offsetWriter shifts the writes of a ranged download to the range start.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o offsetWriter) WriteAt(p []byte, off int64) (int, error) {
+	return o.w.WriteAt(p, o.offset+off)
+}
+
+// WrittenSuffix is appended to the name of a partial download for the
+// file recording how much of it was written from its start without a gap,
+// the part a later run can resume.
+const WrittenSuffix = ".written"
+
+// prefixWriter records the ranges written through it by the parallel
+// requests of a download, to tell how much of the file was written without
+// a gap. It is passed to save every time it grew by step bytes.
+type prefixWriter struct {
+	w      io.WriterAt
+	step   int64
+	save   func(n int64)
+	mu     sync.Mutex
+	ranges map[int64]int64
+	n      int64
+	saved  int64
+}
+
+func newPrefixWriter(w io.WriterAt, step int64, save func(n int64)) *prefixWriter {
+	return &prefixWriter{w: w, step: step, save: save, ranges: make(map[int64]int64)}
+}
+
+func (p *prefixWriter) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.w.WriteAt(b, off)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if end := off + int64(n); off <= p.n {
+		// a range written again from before the end of the prefix
+		if end > p.n {
+			p.n = end
+		}
+	} else if end > p.ranges[off] {
+		p.ranges[off] = end
+	}
+	for {
+		end, ok := p.ranges[p.n]
+		if !ok || end <= p.n {
+			break
+		}
+		delete(p.ranges, p.n)
+		p.n = end
+	}
+	if p.save != nil && p.n-p.saved >= p.step {
+		p.save(p.n)
+		p.saved = p.n
+	}
+	return n, err
+}
+
+// prefix returns the number of bytes written from offset 0 with no gap.
+func (p *prefixWriter) prefix() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+// writtenLength returns the length recorded in the file written of a
+// partial download of size bytes, 0 when there is none.
+func writtenLength(written string, size int64) int64 {
+	data, err := ioutil.ReadFile(written)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	if n > size {
+		return size
+	}
+	return n
+}
+
+func saveWrittenLength(written string, n int64) {
+	if err := ioutil.WriteFile(written, []byte(strconv.FormatInt(n, 10)), 0644); err != nil {
+		log.Println(err)
+	}
+}
+
+// originalSum is what an object records of the SHA-256 of its original
+// data: the sum itself, or its SHA256MAC under masterKey when it is
+// encrypted.
+type originalSum struct {
+	value     string
+	masterKey []byte
+}
+
+// objectSum returns the originalSum the metadata of an object records.
+func objectSum(metadata map[string]*string, masterKey []byte) originalSum {
+	if mac := Metadata(metadata, SHA256MACKey); mac != "" {
+		return originalSum{value: mac, masterKey: masterKey}
+	}
+	return originalSum{value: Metadata(metadata, SHA256Key)}
+}
+
+// of returns what is recorded of the hex SHA-256 sum.
+func (o originalSum) of(sum string) string {
+	if o.masterKey == nil {
+		return sum
+	}
+	return SHA256MAC(o.masterKey, sum)
+}
+
+func checkSHA256(key string, expected originalSum, h hash.Hash) error {
+	if expected.value == "" {
+		return nil
+	}
+	if sum := expected.of(hex.EncodeToString(h.Sum(nil))); sum != expected.value {
+		return &ChecksumError{Key: key, Local: sum, Remote: expected.value}
+	}
+	return nil
+}
+
+// etagPartSize returns the size of the parts whose MD5s make the ETag of
+// the object of head: its size when it was stored by a single request, the
+// size of its first part, asked to the device, when it was stored by a
+// multipart upload. It is 0 when the device does not tell.
+func etagPartSize(s3SVC *s3.S3, bucket, key string, head *s3.HeadObjectOutput) (int64, error) {
+	etag := strings.Trim(aws.StringValue(head.ETag), `"`)
+	i := strings.LastIndex(etag, "-")
+	if i < 0 {
+		if size := aws.Int64Value(head.ContentLength); size > 0 {
+			return size, nil
+		}
+		return 1, nil
+	}
+	part, err := s3SVC.HeadObject(&s3.HeadObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		PartNumber: aws.Int64(1),
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if strconv.FormatInt(aws.Int64Value(part.PartsCount), 10) != etag[i+1:] {
+		return 0, nil
+	}
+	return aws.Int64Value(part.ContentLength), nil
+}
+
+// matchETag checks sums of the data of key stored against its ETag.
+func matchETag(key, etag string, sums *FileSums) error {
+	local := sums.ETag()
+	if strings.Contains(etag, "-") {
+		local = sums.multipartETag()
+	}
+	if !SameETag(local, etag) {
+		return &ChecksumError{Key: key, Local: local, Remote: strings.Trim(etag, `"`)}
+	}
+	return nil
+}
+
+// download downloads key to dst with parallel ranged requests, or to
+// stdout with a single stream when dst is "-". A file is first written to
+// dst with PartSuffix; a partial file left by a previous run is resumed
+// from the end of the bytes it recorded as written without a gap, unless
+// the object changed since. Objects stored
+// compressed or encrypted are decoded. With full checksums, when the object
+// carries SHA256Key metadata, or SHA256MACKey when it is encrypted, the
+// original data is checked against it, and
+// otherwise the data stored is checked against the ETag; a download neither
+// can check is logged as not verified. The bytes received, and those of a
+// resumed partial file, are reported to progress.
+func (t *transfer) download(bucket, key, dst string) (*Result, error) {
+	head, err := HeadObject(t.S3, bucket, key)
+	if err != nil {
+		return t.result, err
+	}
+	t.result.ETag = aws.StringValue(head.ETag)
+	t.result.SHA256 = Metadata(head.Metadata, SHA256Key)
+	var expected originalSum
+	if t.checked() {
+		expected = objectSum(head.Metadata, t.opts.Encoding.Key)
+	}
+	var meta *FileMetadata
+	if t.opts.Preserve && dst != "-" {
+		if meta, err = DecodeFileMetadata(head.Metadata); err != nil {
+			return t.result, err
+		}
+	}
+	if strings.HasSuffix(key, "/") && dst != "-" {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return t.result, errors.WithStack(err)
+		}
+		return t.done(0), t.apply(meta, dst)
+	}
+	if meta != nil && meta.Symlink != "" {
+		if err := restoreSymlink(dst, meta.Symlink); err != nil {
+			return t.result, err
+		}
+		return t.done(0), t.apply(meta, dst)
+	}
+	// the part size of the ETag the stored data is checked against, 0 when it is not
+	var etagPart int64
+	if t.checked() && expected.value == "" {
+		if etagPart, err = etagPartSize(t.S3, bucket, key, head); err != nil {
+			log.Printf("%s not verified: %v\n", key, err)
+		} else if etagPart == 0 {
+			log.Printf("%s not verified: no part size for its ETag %s\n", key, t.result.ETag)
+		}
+	}
+	masterKey := t.opts.Encoding.Key
+	progress := t.progress()
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	if dst == "-" {
+		h := sha256.New()
+		pr, pw := io.Pipe()
+		var stored io.Writer = pw
+		var hasher *partHasher
+		if etagPart > 0 {
+			hasher = newPartHasher(etagPart)
+			stored = io.MultiWriter(pw, hasher)
+		}
+		var n int64
+		go func() {
+			var err error
+			n, err = t.downloader.DownloadWithContext(aws.BackgroundContext(),
+				progressWriterAt{&sequentialWriter{w: stored}, progress}, input, t.downloaderOptions,
+				func(d *s3manager.Downloader) { d.Concurrency = 1 })
+			pw.CloseWithError(err)
+		}()
+		err := decode(head.Metadata, masterKey, pr, io.MultiWriter(os.Stdout, h))
+		pr.CloseWithError(io.ErrClosedPipe)
+		if err != nil {
+			return t.result, err
+		}
+		if hasher != nil {
+			return t.done(n), matchETag(key, t.result.ETag, hasher.finish())
+		}
+		return t.done(n), checkSHA256(key, expected, h)
+	}
+
+	part := dst + PartSuffix
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+
+	// only the bytes recorded as written without a gap are resumed, the
+	// ranges after them may have been written or not
+	written := part + WrittenSuffix
+	size := aws.Int64Value(head.ContentLength)
+	offset := writtenLength(written, fi.Size())
+	if offset > size {
+		offset = 0
+	}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		// the partial file is only valid if the object did not change since
+		input.IfUnmodifiedSince = aws.Time(fi.ModTime())
+	}
+
+	var n int64
+	progress.add(offset)
+	if offset < size {
+		save := func(n int64) { saveWrittenLength(written, offset+n) }
+		w := newPrefixWriter(offsetWriter{file, offset}, t.partBytes(), save)
+		n, err = t.downloader.DownloadWithContext(aws.BackgroundContext(),
+			progressWriterAt{w, progress}, input, t.downloaderOptions)
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusPreconditionFailed {
+			input.Range = nil
+			input.IfUnmodifiedSince = nil
+			progress.add(-offset)
+			offset = 0
+			saveWrittenLength(written, 0)
+			w = newPrefixWriter(file, t.partBytes(), save)
+			n, err = t.downloader.DownloadWithContext(aws.BackgroundContext(), progressWriterAt{w, progress},
+				input, t.downloaderOptions)
+		}
+		if err != nil {
+			// the ranges are written in any order, only the bytes up to the
+			// first gap can be resumed
+			n = w.prefix()
+			saveWrittenLength(written, offset+n)
+		}
+	}
+	if terr := file.Truncate(offset + n); err == nil {
+		err = terr
+	}
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	if err := file.Close(); err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	os.Remove(written)
+
+	if etagPart > 0 {
+		if err := verifyETag(part, key, t.result.ETag, etagPart); err != nil {
+			return t.result, err
+		}
+	}
+	if Encoded(head.Metadata) {
+		err := decodeFile(head.Metadata, masterKey, part, dst, key, expected)
+		if err != nil {
+			return t.result, err
+		}
+		os.Remove(part)
+	} else if err := verifyFile(part, key, expected); err != nil {
+		return t.result, err
+	} else if err := os.Rename(part, dst); err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	return t.done(offset + n), t.apply(meta, dst)
+}
+
+// apply sets the file metadata kept with an object on dst, when there is.
+func (t *transfer) apply(meta *FileMetadata, dst string) error {
+	if meta == nil {
+		return nil
+	}
+	return meta.Apply(dst)
+}
+
+// verifyETag checks the data of key stored, downloaded to path, against
+// its ETag made of parts of partBytes. A corrupt file is removed so the
+// next attempt starts over rather than resuming it.
+func verifyETag(path, key, etag string, partBytes int64) error {
+	sums, err := SumFile(path, partBytes)
+	if err != nil {
+		return err
+	}
+	if err := matchETag(key, etag, sums); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// verifyFile checks a downloaded file against the expected SHA-256. A
+// corrupt file is removed so the next attempt starts over rather than
+// resuming it.
+func verifyFile(path, key string, expected originalSum) error {
+	if expected.value != "" {
+		sum, err := FileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum = expected.of(sum); sum != expected.value {
+			os.Remove(path)
+			return &ChecksumError{Key: key, Local: sum, Remote: expected.value}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package cloud
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+type discardWriterAt struct{}
+
+func (discardWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes [][2]int64
+		want   int64
+	}{
+		{"nothing", nil, 0},
+		{"in order", [][2]int64{{0, 10}, {10, 5}, {15, 5}}, 20},
+		{"out of order", [][2]int64{{10, 10}, {0, 10}, {20, 5}}, 25},
+		{"gap", [][2]int64{{0, 10}, {20, 10}, {30, 10}}, 10},
+		{"missing start", [][2]int64{{10, 10}, {20, 10}}, 0},
+		{"rewritten", [][2]int64{{0, 4}, {0, 10}, {10, 5}}, 15},
+		{"empty write", [][2]int64{{0, 0}, {0, 5}}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved int64
+			w := newPrefixWriter(discardWriterAt{}, 5, func(n int64) { saved = n })
+			for _, write := range tt.writes {
+				w.WriteAt(make([]byte, write[1]), write[0])
+			}
+			if got := w.prefix(); got != tt.want {
+				t.Errorf("prefix = %d, want %d", got, tt.want)
+			}
+			if saved != tt.want {
+				t.Errorf("saved %d, want %d", saved, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadETag(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		corrupt bool
+	}{
+		{"single part", 100, false},
+		{"single part corrupt", 100, true},
+		{"multipart", 2*mb + 100, false},
+		{"multipart corrupt", 2*mb + 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv := testEngine(t)
+			dir := t.TempDir()
+			data := randomBytes(tt.size)
+			src := writeFile(t, dir, "src", data)
+			// no SHA-256 stored to check the download against
+			opts := Options{PartSize: 1, Concurrency: 2, StateDir: dir, Checksum: ChecksumNone}
+			if _, err := e.Upload(testBucket, src, "dst", opts); err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt {
+				srv.Corrupt(testBucket, "dst", tt.size-1)
+			}
+			dst := filepath.Join(dir, "dst")
+			opts.Checksum = ChecksumFull
+			_, err := e.Download(testBucket, "dst", dst, opts)
+			if tt.corrupt {
+				if _, ok := errors.Cause(err).(*ChecksumError); !ok {
+					t.Fatalf("download of a corrupt object gave %v", err)
+				}
+				if _, err := os.Stat(dst + PartSuffix); !os.IsNotExist(err) {
+					t.Errorf("corrupt partial file kept: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+				t.Errorf("downloaded file differs: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package cloud
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// Encoding is how the content of a file is transformed on its way to the
+// device: compressed with Codec, then encrypted when Key, the master key,
+// is set.
+type Encoding struct {
+	Codec string
+	Key   []byte
+}
+
+// Empty reports whether files are uploaded as is.
+func (e Encoding) Empty() bool {
+	return e.Codec == "" && e.Key == nil
+}
+
+// forFile returns the encoding of src, which is not compressed again when
+// it already is.
+func (e Encoding) forFile(src string) (Encoding, error) {
+	if e.Codec == "" {
+		return e, nil
+	}
+	compressed, err := Compressed(src)
+	if err != nil {
+		return e, err
+	}
+	if compressed {
+		e.Codec = ""
+	}
+	return e, nil
+}
+
+// Encoded reports whether an object was stored compressed or encrypted.
+func Encoded(metadata map[string]*string) bool {
+	return Metadata(metadata, CodecKey) != "" || Metadata(metadata, EncryptionKey) != ""
+}
+
+// encodeReader wraps r with the compression and encryption of enc and
+// returns metadata, the one known of the original data, with the one
+// describing them. The SHA-256 of an encrypted object is replaced by its
+// SHA256MAC.
+func encodeReader(r io.Reader, enc Encoding, metadata map[string]*string) (io.Reader, map[string]*string, func(),
+	error) {
+	if metadata == nil {
+		metadata = make(map[string]*string)
+	}
+	done := func() {}
+	if enc.Codec != "" {
+		pr, pw := io.Pipe()
+		go func(r io.Reader) {
+			w, err := compressor(enc.Codec, pw)
+			if err == nil {
+				_, err = io.Copy(w, r)
+				if cerr := w.Close(); err == nil {
+					err = cerr
+				}
+			}
+			pw.CloseWithError(err)
+		}(r)
+		// unblock the compressor if the upload stopped reading
+		done = func() { pr.CloseWithError(io.ErrClosedPipe) }
+		metadata[CodecKey] = aws.String(enc.Codec)
+		r = pr
+	}
+	if enc.Key != nil {
+		if sum := aws.StringValue(metadata[SHA256Key]); sum != "" {
+			delete(metadata, SHA256Key)
+			metadata[SHA256MACKey] = aws.String(SHA256MAC(enc.Key, sum))
+		}
+		er, encMetadata, err := encrypt(r, enc.Key, encryptionAAD(metadata))
+		if err != nil {
+			done()
+			return nil, nil, nil, err
+		}
+		for k, v := range encMetadata {
+			metadata[k] = aws.String(v)
+		}
+		r = er
+	}
+	return r, metadata, done, nil
+}
+
+// encodedUpload compresses and/or encrypts src while it is uploaded to dst.
+// The stored size is not known up front, so the object is streamed like
+// stdin and can't be resumed. With full checksums the SHA-256 metadata, or
+// its SHA256MAC when encrypted, is the one of the original content, read
+// in a first pass, so downloads can check the data they decode. Only the
+// second pass is reported to progress.
+func (t *transfer) encodedUpload(bucket, src, dst string) (*Result, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return t.result, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	if t.checked() {
+		if t.result.SHA256, err = FileSHA256(src); err != nil {
+			return t.result, err
+		}
+	}
+
+	metadata := map[string]*string{OriginalSizeKey: aws.String(strconv.FormatInt(fi.Size(), 10))}
+	if t.result.SHA256 != "" {
+		metadata[SHA256Key] = aws.String(t.result.SHA256)
+	}
+	r, metadata, done, err := encodeReader(countingReader{file, t.progress()}, t.opts.Encoding, metadata)
+	if err != nil {
+		return t.result, err
+	}
+	defer done()
+	return t.streamUpload(bucket, r, dst, metadata)
+}
+
+// decode writes to w the original content of r, an object stored as
+// described by metadata.
+func decode(metadata map[string]*string, masterKey []byte, r io.Reader, w io.Writer) error {
+	if Metadata(metadata, EncryptionKey) != "" {
+		var err error
+		if r, err = decrypt(r, metadata, masterKey); err != nil {
+			return err
+		}
+	}
+	dec, err := Decompressor(Metadata(metadata, CodecKey), r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer dec.Close()
+	_, err = io.Copy(w, dec)
+	return errors.WithStack(err)
+}
+
+// decodeFile decodes the downloaded part file into dst, checking the
+// SHA-256 of the original content on the way.
+func decodeFile(metadata map[string]*string, masterKey []byte, part, dst, key string, expected originalSum) error {
+	in, err := os.Open(part)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	h := sha256.New()
+	err = decode(metadata, masterKey, in, io.MultiWriter(out, h))
+	if cerr := out.Close(); err == nil {
+		err = errors.WithStack(cerr)
+	}
+	if err == nil {
+		err = checkSHA256(key, expected, h)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if _, ok := err.(*ChecksumError); ok {
+			os.Remove(part)
+		}
+		return err
+	}
+	return errors.WithStack(os.Rename(tmp, dst))
+}
@@ -0,0 +1,296 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Client-side encryption metadata. Objects are encrypted with a random
+// data key per object, itself encrypted ("wrapped") with the master key.
+const (
+	EncryptionKey  = "snowball-encryption"
+	WrappedKeyKey  = "snowball-wrapped-key"
+	NoncePrefixKey = "snowball-nonce-prefix"
+	MasterKeyIDKey = "snowball-master-key-id"
+	// SHA256MACKey holds, in place of the SHA-256 of the original data of
+	// an encrypted object, an HMAC of it keyed from the master key, so the
+	// metadata tells nothing of the data.
+	SHA256MACKey = "snowball-sha256-mac"
+
+	// EncryptionScheme is AES-256-GCM over chunks of encChunkSize bytes of
+	// plaintext. The nonce of a chunk is the random 7 bytes prefix, the
+	// big endian 32 bits chunk counter and a last chunk flag byte, so
+	// chunks can't be reordered, dropped or truncated unnoticed. Every
+	// chunk is sealed with the metadata of boundKeys as additional data, so
+	// it can't be changed either.
+	EncryptionScheme = "aes-256-gcm-chunked-v2"
+	// encryptionSchemeV1 is EncryptionScheme with no additional data.
+	encryptionSchemeV1 = "aes-256-gcm-chunked-v1"
+
+	encChunkSize   = 64 * 1024
+	encPrefixSize  = 7
+	masterKeyBytes = 32
+)
+
+// ParseMasterKey decodes a 256 bits master key given raw, hex or base64.
+func ParseMasterKey(data []byte) ([]byte, error) {
+	if len(data) == masterKeyBytes {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == masterKeyBytes {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == masterKeyBytes {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be %d bytes, raw, hex or base64 encoded", masterKeyBytes)
+}
+
+// LoadMasterKey reads the master key from a key file.
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return ParseMasterKey(data)
+}
+
+// masterKeyID identifies a master key without revealing it, to tell a
+// wrong key from corrupt data.
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SHA256MAC returns the HMAC an encrypted object records of sum, the hex
+// SHA-256 of its original data, under a key derived from masterKey.
+func SHA256MAC(masterKey []byte, sum string) string {
+	derive := hmac.New(sha256.New, masterKey)
+	derive.Write([]byte("snowball sha256 mac"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(sum))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SameSHA256 reports whether sum is the SHA-256 of the original data of an
+// object with metadata, recorded as is or, when it is encrypted, as its
+// SHA256MAC under masterKey. It is false when the object records neither.
+func SameSHA256(metadata map[string]*string, masterKey []byte, sum string) bool {
+	if stored := Metadata(metadata, SHA256Key); stored != "" {
+		return stored == sum
+	}
+	if stored := Metadata(metadata, SHA256MACKey); stored != "" && masterKey != nil {
+		return hmac.Equal([]byte(stored), []byte(SHA256MAC(masterKey, sum)))
+	}
+	return false
+}
+
+// boundKeys is the metadata describing the original data of an encrypted
+// object, which its chunks are sealed with.
+var boundKeys = []string{CodecKey, OriginalSizeKey, SHA256MACKey}
+
+// encryptionAAD returns the additional data the chunks of an object with
+// metadata are sealed with.
+func encryptionAAD(metadata map[string]*string) []byte {
+	var b bytes.Buffer
+	for _, key := range boundKeys {
+		fmt.Fprintf(&b, "%s=%s\n", key, Metadata(metadata, key))
+	}
+	return b.Bytes()
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	return gcm, errors.WithStack(err)
+}
+
+func wrapKey(masterKey, dataKey []byte) (string, error) {
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, dataKey, nil)), nil
+}
+
+func unwrapKey(masterKey []byte, wrapped string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	key, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	return key, errors.Wrap(err, "unwrapping data key")
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptReader struct {
+	r       io.Reader
+	gcm     cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	out     *bytes.Reader
+	done    bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for e.out == nil || e.out.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.r, e.plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		sealed := e.gcm.Seal(nil, chunkNonce(e.prefix, e.counter, last), e.plain[:n], e.aad)
+		e.out = bytes.NewReader(sealed)
+		e.counter++
+		e.done = last
+	}
+	return e.out.Read(p)
+}
+
+// encrypt wraps r so it reads encrypted with a new data key, sealed with
+// aad, and returns the metadata needed to decrypt it with masterKey.
+func encrypt(r io.Reader, masterKey, aad []byte) (io.Reader, map[string]string, error) {
+	dataKey := make([]byte, 32)
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	wrapped, err := wrapKey(masterKey, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := map[string]string{
+		EncryptionKey:  EncryptionScheme,
+		WrappedKeyKey:  wrapped,
+		NoncePrefixKey: base64.StdEncoding.EncodeToString(prefix),
+		MasterKeyIDKey: masterKeyID(masterKey),
+	}
+	return &encryptReader{r: r, gcm: gcm, aad: aad, prefix: prefix, plain: make([]byte, encChunkSize)}, metadata, nil
+}
+
+type decryptReader struct {
+	r       io.Reader
+	gcm     cipher.AEAD
+	aad     []byte
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	out     *bytes.Reader
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for d.out == nil || d.out.Len() == 0 {
+		if d.done {
+			// nothing may follow the last chunk
+			if n, _ := d.r.Read(make([]byte, 1)); n > 0 {
+				return 0, fmt.Errorf("data after the last encrypted chunk")
+			}
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.r, d.sealed)
+		if err == io.EOF {
+			return 0, fmt.Errorf("encrypted data truncated")
+		}
+		short := err == io.ErrUnexpectedEOF
+		if err != nil && !short {
+			return 0, err
+		}
+		plain, err := d.gcm.Open(nil, chunkNonce(d.prefix, d.counter, short), d.sealed[:n], d.aad)
+		last := short
+		if err != nil && !short {
+			// a full chunk may still be the last one
+			plain, err = d.gcm.Open(nil, chunkNonce(d.prefix, d.counter, true), d.sealed[:n], d.aad)
+			last = true
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "decrypting chunk %d", d.counter)
+		}
+		d.out = bytes.NewReader(plain)
+		d.counter++
+		d.done = last
+	}
+	return d.out.Read(p)
+}
+
+// decrypt wraps r, encrypted as described by metadata, to read it back in
+// clear with masterKey.
+func decrypt(r io.Reader, metadata map[string]*string, masterKey []byte) (io.Reader, error) {
+	var aad []byte
+	switch scheme := Metadata(metadata, EncryptionKey); scheme {
+	case EncryptionScheme:
+		aad = encryptionAAD(metadata)
+	case encryptionSchemeV1:
+	default:
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+	if masterKey == nil {
+		return nil, fmt.Errorf("object is encrypted, no master key given")
+	}
+	if id := Metadata(metadata, MasterKeyIDKey); id != masterKeyID(masterKey) {
+		return nil, fmt.Errorf("object was encrypted with master key %s, not %s", id, masterKeyID(masterKey))
+	}
+	dataKey, err := unwrapKey(masterKey, Metadata(metadata, WrappedKeyKey))
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := base64.StdEncoding.DecodeString(Metadata(metadata, NoncePrefixKey))
+	if err != nil || len(prefix) != encPrefixSize {
+		return nil, fmt.Errorf("invalid nonce prefix")
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, gcm: gcm, aad: aad, prefix: prefix,
+		sealed: make([]byte, encChunkSize+gcm.Overhead())}, nil
+}
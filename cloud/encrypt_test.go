@@ -0,0 +1,234 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func encryptBytes(t *testing.T, data, masterKey []byte) ([]byte, map[string]*string) {
+	r, metadata, err := encrypt(bytes.NewReader(data), masterKey, encryptionAAD(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed, aws.StringMap(metadata)
+}
+
+func decryptBytes(sealed []byte, metadata map[string]*string, masterKey []byte) ([]byte, error) {
+	r, err := decrypt(bytes.NewReader(sealed), metadata, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	masterKey := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"chunk minus one", encChunkSize - 1},
+		{"one chunk", encChunkSize},
+		{"chunk plus one", encChunkSize + 1},
+		{"several chunks", 3*encChunkSize + 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := make([]byte, tt.size)
+			rand.Read(data)
+			sealed, metadata := encryptBytes(t, data, masterKey)
+			got, err := decryptBytes(sealed, metadata, masterKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decrypted %d bytes differ from the %d encrypted", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	masterKey := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	data := make([]byte, 3*encChunkSize+100)
+	rand.Read(data)
+	chunk := encChunkSize + 16
+	tests := []struct {
+		name   string
+		tamper func(sealed []byte) []byte
+	}{
+		{"flipped byte", func(sealed []byte) []byte {
+			sealed[chunk+10] ^= 1
+			return sealed
+		}},
+		{"last chunk dropped", func(sealed []byte) []byte {
+			return sealed[:3*chunk]
+		}},
+		{"last chunk truncated", func(sealed []byte) []byte {
+			return sealed[:len(sealed)-1]
+		}},
+		{"chunks swapped", func(sealed []byte) []byte {
+			swapped := append([]byte{}, sealed[chunk:2*chunk]...)
+			swapped = append(swapped, sealed[:chunk]...)
+			return append(swapped, sealed[2*chunk:]...)
+		}},
+		{"data appended", func(sealed []byte) []byte {
+			return append(sealed, 0)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, metadata := encryptBytes(t, data, masterKey)
+			if _, err := decryptBytes(tt.tamper(sealed), metadata, masterKey); err == nil {
+				t.Error("tampered data decrypted with no error")
+			}
+		})
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	masterKey := make([]byte, masterKeyBytes)
+	other := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	rand.Read(other)
+	sealed, metadata := encryptBytes(t, []byte("snowball"), masterKey)
+	if _, err := decryptBytes(sealed, metadata, other); err == nil {
+		t.Error("decrypted with the wrong master key")
+	}
+	if _, err := decryptBytes(sealed, metadata, nil); err == nil {
+		t.Error("decrypted with no master key")
+	}
+}
+
+func TestDecryptMetadataChanged(t *testing.T) {
+	masterKey := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	data := []byte("snowball")
+	sum := sha256.Sum256(data)
+	tests := []struct {
+		name   string
+		change func(metadata map[string]*string)
+	}{
+		{"original size", func(metadata map[string]*string) { metadata[OriginalSizeKey] = aws.String("9") }},
+		{"codec", func(metadata map[string]*string) { metadata[CodecKey] = aws.String(CodecGzip) }},
+		{"checksum dropped", func(metadata map[string]*string) { delete(metadata, SHA256MACKey) }},
+	}
+	for _, tt := range tests {
+		metadata := map[string]*string{OriginalSizeKey: aws.String("8"),
+			SHA256Key: aws.String(hex.EncodeToString(sum[:]))}
+		r, metadata, _, err := encodeReader(bytes.NewReader(data), Encoding{Key: masterKey}, metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata[SHA256Key] != nil {
+			t.Fatal("SHA-256 of an encrypted object stored in clear")
+		}
+		if !SameSHA256(metadata, masterKey, hex.EncodeToString(sum[:])) {
+			t.Fatal("HMAC of the SHA-256 does not match the data")
+		}
+		if got, err := decryptBytes(sealed, metadata, masterKey); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("decrypted %q: %v", got, err)
+		}
+		tt.change(metadata)
+		if _, err := decryptBytes(sealed, metadata, masterKey); err == nil {
+			t.Errorf("%s: decrypted with its metadata changed", tt.name)
+		}
+	}
+}
+
+func TestDecryptV1(t *testing.T) {
+	masterKey := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	data := []byte("snowball")
+	// objects encrypted before the metadata was bound have no additional data
+	r, metadata, err := encrypt(bytes.NewReader(data), masterKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata[EncryptionKey] = encryptionSchemeV1
+	metadata[OriginalSizeKey] = "8"
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decryptBytes(sealed, aws.StringMap(metadata), masterKey); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("decrypted %q: %v", got, err)
+	}
+}
+
+func TestSameSHA256(t *testing.T) {
+	masterKey := make([]byte, masterKeyBytes)
+	other := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	rand.Read(other)
+	sum := "b9cc0d753df06c3caaa92bf9b015b678b2ab651cc20947042f35e64d9c3f9801"
+	tests := []struct {
+		name      string
+		metadata  map[string]string
+		masterKey []byte
+		want      bool
+	}{
+		{"same", map[string]string{SHA256Key: sum}, nil, true},
+		{"different", map[string]string{SHA256Key: "0123"}, nil, false},
+		{"none", map[string]string{}, masterKey, false},
+		{"same HMAC", map[string]string{SHA256MACKey: SHA256MAC(masterKey, sum)}, masterKey, true},
+		{"HMAC with no key", map[string]string{SHA256MACKey: SHA256MAC(masterKey, sum)}, nil, false},
+		{"HMAC under another key", map[string]string{SHA256MACKey: SHA256MAC(other, sum)}, masterKey, false},
+	}
+	for _, tt := range tests {
+		if got := SameSHA256(aws.StringMap(tt.metadata), tt.masterKey, sum); got != tt.want {
+			t.Errorf("%s: SameSHA256 = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEncryptedUploadRoundTrip(t *testing.T) {
+	e, srv := testEngine(t)
+	masterKey := make([]byte, masterKeyBytes)
+	rand.Read(masterKey)
+	dir := t.TempDir()
+	data := randomBytes(mb + 100)
+	src := writeFile(t, dir, "src", data)
+	opts := Options{PartSize: 5, Concurrency: 2, StateDir: dir, Encoding: Encoding{Codec: CodecGzip, Key: masterKey}}
+	if _, err := e.Upload(testBucket, src, "dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	obj := srv.Object(testBucket, "dst")
+	if obj == nil {
+		t.Fatal("no object stored")
+	}
+	if _, ok := obj.Metadata[http.CanonicalHeaderKey(SHA256Key)]; ok {
+		t.Error("SHA-256 of an encrypted object stored in clear")
+	}
+	sum := sha256.Sum256(data)
+	if !SameSHA256(aws.StringMap(obj.Metadata), masterKey, hex.EncodeToString(sum[:])) {
+		t.Error("HMAC of the SHA-256 does not match the file")
+	}
+	dst := filepath.Join(dir, "dst")
+	if _, err := e.Download(testBucket, "dst", dst, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded file differs: %v", err)
+	}
+}
@@ -0,0 +1,382 @@
+package cloud
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/dustin/go-humanize"
+	"github.com/iandri/snowball/utils"
+	"github.com/pkg/errors"
+)
+
+// ChecksumMode is how much a transfer checks the data it moves.
+type ChecksumMode string
+
+const (
+	// ChecksumFull sends the MD5 of every request body, checks the ETags
+	// the device returns and stores the SHA-256 of the original data as
+	// metadata, which downloads check.
+	ChecksumFull ChecksumMode = "full"
+	// ChecksumNone trusts the transport: nothing is hashed that the
+	// transfer does not need anyway, and downloads are not checked.
+	ChecksumNone ChecksumMode = "none"
+)
+
+// ParseChecksumMode validates a --checksum value, empty meaning full.
+func ParseChecksumMode(s string) (ChecksumMode, error) {
+	switch ChecksumMode(s) {
+	case "", ChecksumFull:
+		return ChecksumFull, nil
+	case ChecksumNone:
+		return ChecksumNone, nil
+	}
+	return "", fmt.Errorf("unknown checksum mode %q, expected %s or %s", s, ChecksumFull, ChecksumNone)
+}
+
+// Hooks follow a transfer. Any of them may be nil, and they may be called
+// from several goroutines at once.
+type Hooks struct {
+	// Progress is told the bytes moved.
+	Progress Progress
+	// Part is called when the device accepted a part of an upload or sent
+	// a range of a download, numbered from 1, of size bytes.
+	Part func(number, size int64)
+	// Retry is called when a request of operation failed with err and is
+	// sent again.
+	Retry func(operation string, err error)
+}
+
+// Options set how a transfer is made. The zero value uploads and downloads
+// files as is, with the s3manager defaults.
+type Options struct {
+	// PartSize is the size of a part in MB, Concurrency the number of parts
+	// moved at once.
+	PartSize    int64
+	Concurrency int
+	// Metadata is stored with the uploaded objects, along with the one
+	// describing their encoding and checksum.
+	Metadata map[string]*string
+	// StorageClass is the one of the uploaded objects, the bucket default
+	// when empty.
+	StorageClass string
+	Checksum     ChecksumMode
+	// Encoding compresses and encrypts the uploads. Its Key decrypts the
+	// downloads.
+	Encoding Encoding
+	// StateDir keeps the state of the resumable uploads.
+	StateDir string
+	// Preserve keeps the POSIX metadata of the uploaded files with their
+	// objects, with their extended attributes when Xattrs is set, and
+	// uploads symlinks as links rather than the files they point to when
+	// Symlinks is. Downloads reapply what was kept.
+	Preserve bool
+	Xattrs   bool
+	Symlinks bool
+	Hooks    Hooks
+}
+
+// Result is the outcome of a transfer.
+type Result struct {
+	Location string
+	// ETag is the one of the object, SHA256 the checksum of its original
+	// data when it was computed or stored.
+	ETag    string
+	SHA256  string
+	Size    int64
+	Parts   int64
+	Retries int64
+	Start   time.Time
+	Elapsed time.Duration
+}
+
+func (r Result) String() string {
+	size := humanize.Bytes(uint64(r.Size))
+	seconds := r.Elapsed.Seconds()
+	elapsed := utils.HumanizeDuration(r.Elapsed)
+	bandwidth := float64(r.Size) / seconds / 1024.0 / 1024.0
+	s := fmt.Sprintf("Location     : %s\nSize         : %s\nElapsed time : %s\nBandwidth    :% 4.0f MBytes/sec\n",
+		r.Location, size, elapsed, bandwidth)
+	if r.ETag != "" {
+		s += fmt.Sprintf("ETag         : %s\n", r.ETag)
+	}
+	if r.SHA256 != "" {
+		s += fmt.Sprintf("SHA-256      : %s\n", r.SHA256)
+	}
+	return s + fmt.Sprintf("Parts        : %d\nRetries      : %d\n", r.Parts, r.Retries)
+}
+
+// Engine makes the transfers of a session. Its uploader and downloader are
+// shared by every transfer, each setting its options on its own copy.
+type Engine struct {
+	S3         *s3.S3
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+}
+
+// NewEngine returns the transfer engine of s3SVC.
+func NewEngine(s3SVC *s3.S3) *Engine {
+	return &Engine{
+		S3:         s3SVC,
+		uploader:   s3manager.NewUploaderWithClient(s3SVC),
+		downloader: s3manager.NewDownloaderWithClient(s3SVC),
+	}
+}
+
+// transfer is a single call to an Engine.
+type transfer struct {
+	*Engine
+	opts    Options
+	result  *Result
+	parts   int64
+	retries int64
+
+	mu sync.Mutex
+	// etag is the one the device returned for the object uploaded.
+	etag string
+}
+
+func (e *Engine) newTransfer(location string, opts Options) *transfer {
+	if opts.PartSize <= 0 {
+		opts.PartSize = s3manager.DefaultUploadPartSize / 1024 / 1024
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = s3manager.DefaultUploadConcurrency
+	}
+	if opts.Checksum == "" {
+		opts.Checksum = ChecksumFull
+	}
+	return &transfer{
+		Engine: e,
+		opts:   opts,
+		result: &Result{Location: location, Start: time.Now().UTC()},
+	}
+}
+
+func (t *transfer) progress() Progress {
+	return t.opts.Hooks.Progress
+}
+
+func (t *transfer) checked() bool {
+	return t.opts.Checksum != ChecksumNone
+}
+
+func (t *transfer) partBytes() int64 {
+	return t.opts.PartSize * 1024 * 1024
+}
+
+// metadata returns the metadata of an uploaded object, the one of the
+// options with extra added.
+func (t *transfer) metadata(extra map[string]*string) map[string]*string {
+	metadata := make(map[string]*string, len(t.opts.Metadata)+len(extra))
+	for k, v := range t.opts.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range extra {
+		metadata[k] = v
+	}
+	return metadata
+}
+
+func (t *transfer) storageClass() *string {
+	if t.opts.StorageClass == "" {
+		return nil
+	}
+	return aws.String(t.opts.StorageClass)
+}
+
+// part reports a part accepted or received to the Part hook.
+func (t *transfer) part(number, size int64) {
+	if t.opts.Hooks.Part != nil {
+		t.opts.Hooks.Part(number, size)
+	}
+}
+
+// request is the option given to every request of the transfer, counting
+// its retries and the parts it moves. With full checksums every part and
+// object is sent with the Content-MD5 of its body and the ETag returned
+// checked against it, else no MD5 is computed.
+func (t *transfer) request(r *request.Request) {
+	r.Config.S3DisableContentMD5Validation = aws.Bool(!t.checked())
+	if t.checked() {
+		r.Handlers.Unmarshal.PushBack(checkETag)
+	}
+	r.Handlers.Retry.PushBack(func(r *request.Request) {
+		if !r.WillRetry() {
+			return
+		}
+		atomic.AddInt64(&t.retries, 1)
+		if t.opts.Hooks.Retry != nil {
+			t.opts.Hooks.Retry(r.Operation.Name, r.Error)
+		}
+	})
+	r.Handlers.Complete.PushBack(func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		switch out := r.Data.(type) {
+		case *s3.PutObjectOutput:
+			t.setETag(aws.StringValue(out.ETag))
+		case *s3.CompleteMultipartUploadOutput:
+			t.setETag(aws.StringValue(out.ETag))
+		}
+		switch in := r.Params.(type) {
+		case *s3.PutObjectInput:
+			atomic.AddInt64(&t.parts, 1)
+			t.part(1, r.HTTPRequest.ContentLength)
+		case *s3.UploadPartInput:
+			atomic.AddInt64(&t.parts, 1)
+			t.part(aws.Int64Value(in.PartNumber), r.HTTPRequest.ContentLength)
+		case *s3.GetObjectInput:
+			t.part(atomic.AddInt64(&t.parts, 1), r.HTTPResponse.ContentLength)
+		}
+	})
+}
+
+// checkETag fails a part or object upload whose ETag is not the MD5 of the
+// body sent, the device having stored something else.
+func checkETag(r *request.Request) {
+	var key, etag string
+	switch out := r.Data.(type) {
+	case *s3.PutObjectOutput:
+		key = aws.StringValue(r.Params.(*s3.PutObjectInput).Key)
+		etag = aws.StringValue(out.ETag)
+	case *s3.UploadPartOutput:
+		in := r.Params.(*s3.UploadPartInput)
+		key = fmt.Sprintf("%s part %d", aws.StringValue(in.Key), aws.Int64Value(in.PartNumber))
+		etag = aws.StringValue(out.ETag)
+	default:
+		return
+	}
+	sum, err := base64.StdEncoding.DecodeString(r.HTTPRequest.Header.Get("Content-Md5"))
+	if r.Error != nil || err != nil || len(sum) == 0 {
+		return
+	}
+	if local := hex.EncodeToString(sum); !SameETag(local, etag) {
+		r.Error = &ChecksumError{Key: key, Local: local, Remote: etag}
+	}
+}
+
+func (t *transfer) setETag(etag string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.etag = etag
+}
+
+// objectETag returns the ETag the device returned for the object uploaded.
+func (t *transfer) objectETag() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.etag
+}
+
+func (t *transfer) uploaderOptions(u *s3manager.Uploader) {
+	u.PartSize = t.partBytes()
+	u.Concurrency = t.opts.Concurrency
+	u.RequestOptions = append(u.RequestOptions, t.request)
+}
+
+func (t *transfer) downloaderOptions(d *s3manager.Downloader) {
+	d.PartSize = t.partBytes()
+	d.Concurrency = t.opts.Concurrency
+	d.RequestOptions = append(d.RequestOptions, t.request)
+}
+
+// done completes the result with what the transfer counted.
+func (t *transfer) done(size int64) *Result {
+	t.result.Size = size
+	t.result.Retries = atomic.LoadInt64(&t.retries)
+	if t.result.Parts == 0 {
+		t.result.Parts = atomic.LoadInt64(&t.parts)
+	}
+	t.result.Elapsed = time.Since(t.result.Start)
+	return t.result
+}
+
+// Upload uploads src to dst: encoded as set by opts, in resumable parts
+// when it is larger than a part, else in a single request. A directory, or
+// a symlink kept as a link, is uploaded as an empty marker object.
+func (e *Engine) Upload(bucket, src, dst string, opts Options) (*Result, error) {
+	t := e.newTransfer(fmt.Sprintf("%s/%s/%s", e.S3.Endpoint, bucket, dst), opts)
+	stat := os.Stat
+	if opts.Preserve && opts.Symlinks {
+		stat = os.Lstat
+	}
+	fi, err := stat(src)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	if opts.Preserve {
+		m, err := ReadFileMetadata(src, opts.Xattrs, opts.Symlinks)
+		if err != nil {
+			return t.result, err
+		}
+		t.opts.Metadata = t.metadata(m.Encode())
+	}
+	if fi.IsDir() {
+		return t.putMarker(bucket, markerKey(dst))
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return t.putMarker(bucket, dst)
+	}
+	enc, err := opts.Encoding.forFile(src)
+	if err != nil {
+		return t.result, err
+	}
+	if !enc.Empty() {
+		t.opts.Encoding = enc
+		return t.encodedUpload(bucket, src, dst)
+	}
+	if fi.Size() >= t.partBytes() {
+		return t.resumableUpload(bucket, src, dst)
+	}
+	return t.putObject(bucket, src, dst)
+}
+
+// UploadStream uploads r, of unknown length, to dst, compressed and
+// encrypted as set by opts. At most Concurrency+1 parts are held in
+// memory, which caps the stream at s3manager.MaxUploadParts parts.
+func (e *Engine) UploadStream(bucket string, r io.Reader, dst string, opts Options) (*Result, error) {
+	t := e.newTransfer(fmt.Sprintf("%s/%s/%s", e.S3.Endpoint, bucket, dst), opts)
+	// the SHA-256 of what was read, before it is encoded
+	h := sha256.New()
+	if t.checked() {
+		r = io.TeeReader(r, h)
+	}
+	r, metadata, done, err := encodeReader(countingReader{r, t.progress()}, opts.Encoding, nil)
+	if err != nil {
+		return t.result, err
+	}
+	defer done()
+	result, err := t.streamUpload(bucket, r, dst, metadata)
+	if err == nil && t.checked() {
+		result.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	return result, err
+}
+
+// UploadBatch packs srcs into a single tar object dst, streamed while it
+// is built, and flags it so the device extracts each file to its name in
+// names.
+func (e *Engine) UploadBatch(bucket string, srcs, names []string, dst string, opts Options) (*Result, error) {
+	t := e.newTransfer(fmt.Sprintf("%s/%s/%s", e.S3.Endpoint, bucket, dst), opts)
+	return t.uploadBatch(bucket, srcs, names, dst)
+}
+
+// Download downloads key to dst, or to stdout when dst is "-", decoding
+// the objects stored compressed or encrypted with the Key of
+// opts.Encoding.
+func (e *Engine) Download(bucket, key, dst string, opts Options) (*Result, error) {
+	t := e.newTransfer(fmt.Sprintf("s3://%s/%s", bucket, key), opts)
+	return t.download(bucket, key, dst)
+}
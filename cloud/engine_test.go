@@ -0,0 +1,35 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/iandri/snowball/cloud/s3test"
+)
+
+const testBucket = "test"
+
+// testEngine returns an engine of a server holding testBucket, closed at
+// the end of the test.
+func testEngine(t *testing.T) (*Engine, *s3test.Server) {
+	srv := s3test.NewServer(testBucket)
+	t.Cleanup(srv.Close)
+	return NewEngine(srv.Client()), srv
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// writeFile writes data to name under dir and returns its path.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
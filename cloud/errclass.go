@@ -0,0 +1,142 @@
+package cloud
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/pkg/errors"
+)
+
+// ErrorClass groups transfer errors by what can be done about them.
+type ErrorClass string
+
+// Error classes returned by Classify.
+const (
+	ErrNetwork      ErrorClass = "network"
+	ErrThrottling   ErrorClass = "throttling"
+	ErrServer       ErrorClass = "server"
+	ErrChecksum     ErrorClass = "checksum"
+	ErrAuth         ErrorClass = "auth"
+	ErrNoSuchBucket ErrorClass = "no-such-bucket"
+	ErrDeviceFull   ErrorClass = "device-full"
+	ErrLocalIO      ErrorClass = "local-io"
+	ErrCanceled     ErrorClass = "canceled"
+	ErrOther        ErrorClass = "other"
+)
+
+// Transient reports whether retrying may succeed.
+func (c ErrorClass) Transient() bool {
+	switch c {
+	case ErrNetwork, ErrThrottling, ErrServer, ErrChecksum:
+		return true
+	}
+	return false
+}
+
+// Fatal reports whether every other transfer of the run will fail the same
+// way, so the run should stop.
+func (c ErrorClass) Fatal() bool {
+	switch c {
+	case ErrAuth, ErrNoSuchBucket, ErrDeviceFull:
+		return true
+	}
+	return false
+}
+
+var awsCodes = map[string]ErrorClass{
+	"InvalidAccessKeyId":           ErrAuth,
+	"SignatureDoesNotMatch":        ErrAuth,
+	"AccessDenied":                 ErrAuth,
+	"ExpiredToken":                 ErrAuth,
+	"InvalidToken":                 ErrAuth,
+	"AuthorizationHeaderMalformed": ErrAuth,
+	"RequestTimeTooSkewed":         ErrAuth,
+	"SlowDown":                     ErrThrottling,
+	"Throttling":                   ErrThrottling,
+	"ThrottlingException":          ErrThrottling,
+	"RequestLimitExceeded":         ErrThrottling,
+	"TooManyRequests":              ErrThrottling,
+	"NoSuchBucket":                 ErrNoSuchBucket,
+	"InsufficientCapacity":         ErrDeviceFull,
+	"InsufficientStorage":          ErrDeviceFull,
+	"InternalError":                ErrServer,
+	"ServiceUnavailable":           ErrServer,
+	"RequestError":                 ErrNetwork,
+	"ResponseTimeout":              ErrNetwork,
+	request.CanceledErrorCode:      ErrCanceled,
+}
+
+// Classify returns the class of an error returned by a transfer.
+func Classify(err error) ErrorClass {
+	err = errors.Cause(err)
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *ChecksumError:
+		return ErrChecksum
+	case awserr.Error:
+		class, known := awsCodes[e.Code()]
+		if known && class != ErrNetwork {
+			return class
+		}
+		if reqErr, ok := e.(awserr.RequestFailure); ok {
+			switch status := reqErr.StatusCode(); {
+			case status == http.StatusUnauthorized || status == http.StatusForbidden:
+				return ErrAuth
+			case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable:
+				return ErrThrottling
+			case status == http.StatusInsufficientStorage:
+				return ErrDeviceFull
+			case status >= 500:
+				return ErrServer
+			}
+		}
+		// errors of s3manager and the SDK wrap the one that caused them, a
+		// failed request may come from reading a local file
+		if e.OrigErr() != nil {
+			if orig := Classify(e.OrigErr()); orig != ErrOther || !known {
+				return orig
+			}
+		}
+		if known {
+			return class
+		}
+		return ErrOther
+	case net.Error:
+		return ErrNetwork
+	case *os.PathError, *os.LinkError, *os.SyscallError:
+		if errno, ok := underlyingErrno(e); ok && errno == syscall.ENOSPC {
+			return ErrDeviceFull
+		}
+		return ErrLocalIO
+	}
+	if err == io.ErrUnexpectedEOF || err == syscall.ECONNRESET || err == syscall.EPIPE {
+		return ErrNetwork
+	}
+	if err == syscall.ENOSPC {
+		return ErrDeviceFull
+	}
+	if err == context.Canceled {
+		return ErrCanceled
+	}
+	return ErrOther
+}
+
+func underlyingErrno(err error) (syscall.Errno, bool) {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return errno, ok
+}
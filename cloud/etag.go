@@ -0,0 +1,137 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SHA256Key is the user metadata holding the SHA-256 of the whole object.
+const SHA256Key = "sha256"
+
+// FileSums are the checksums of a local file split in parts of PartSize
+// bytes, computed in a single read.
+type FileSums struct {
+	SHA256   string   `json:"sha256"`
+	PartSize int64    `json:"part_size"`
+	PartMD5s []string `json:"part_md5s"`
+}
+
+// ChecksumError reports an object the device stored with other content
+// than what was read locally.
+type ChecksumError struct {
+	Key    string
+	Local  string
+	Remote string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: local %s, remote %s", e.Key, e.Local, e.Remote)
+}
+
+// SumFile reads src once, computing the SHA-256 of the whole file and the
+// MD5 of each of its parts of partBytes.
+func SumFile(src string, partBytes int64) (*FileSums, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	sums := &FileSums{PartSize: partBytes}
+	whole := sha256.New()
+	for {
+		h := md5.New()
+		n, err := io.CopyN(io.MultiWriter(h, whole), file, partBytes)
+		if err != nil && err != io.EOF {
+			return nil, errors.WithStack(err)
+		}
+		if n == 0 && len(sums.PartMD5s) > 0 {
+			break
+		}
+		sums.PartMD5s = append(sums.PartMD5s, hex.EncodeToString(h.Sum(nil)))
+		if n < partBytes {
+			break
+		}
+	}
+	sums.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return sums, nil
+}
+
+// FileSHA256 returns the hex SHA-256 of src.
+func FileSHA256(src string) (string, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ETag returns the ETag S3 computes for the file uploaded in these parts.
+func (f *FileSums) ETag() string {
+	if len(f.PartMD5s) == 1 {
+		return f.PartMD5s[0]
+	}
+	h := md5.New()
+	for _, sum := range f.PartMD5s {
+		b, _ := hex.DecodeString(sum)
+		h.Write(b)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(f.PartMD5s))
+}
+
+// multipartETag returns the ETag of the file uploaded as a multipart upload,
+// which keeps the part count suffix even for a single part.
+func (f *FileSums) multipartETag() string {
+	if len(f.PartMD5s) > 1 {
+		return f.ETag()
+	}
+	b, _ := hex.DecodeString(f.PartMD5s[0])
+	sum := md5.Sum(b)
+	return fmt.Sprintf("%s-1", hex.EncodeToString(sum[:]))
+}
+
+// contentMD5 returns the base64 Content-MD5 header value of an hex MD5.
+func contentMD5(sum string) string {
+	b, _ := hex.DecodeString(sum)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// LocalETag computes the ETag S3 would report for src when uploaded with the
+// given part size in MB: the plain MD5 for single part uploads, the MD5 of
+// the concatenated part MD5s followed by the part count otherwise.
+func LocalETag(src string, partSize int64) (string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if fi.Size() < partSize*1024*1024 {
+		sums, err := SumFile(src, partSize*1024*1024)
+		if err != nil {
+			return "", err
+		}
+		return sums.ETag(), nil
+	}
+	sums, err := SumFile(src, PartBytes(fi.Size(), partSize))
+	if err != nil {
+		return "", err
+	}
+	return sums.multipartETag(), nil
+}
+
+// SameETag compares a local ETag with the quoted one returned by S3.
+func SameETag(local, remote string) bool {
+	return local == strings.Trim(remote, `"`)
+}
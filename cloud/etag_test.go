@@ -0,0 +1,87 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// expectedETag computes the ETag of data uploaded in parts of partBytes.
+func expectedETag(data []byte, partBytes int) string {
+	var sums []byte
+	parts := 0
+	for start := 0; start < len(data) || parts == 0; start += partBytes {
+		end := start + partBytes
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[start:end])
+		sums = append(sums, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+}
+
+func TestLocalETag(t *testing.T) {
+	const mb = 1024 * 1024
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		size int
+		want func(data []byte) string
+	}{
+		{"empty", 0, func(data []byte) string {
+			sum := md5.Sum(data)
+			return hex.EncodeToString(sum[:])
+		}},
+		{"single part", mb / 2, func(data []byte) string {
+			sum := md5.Sum(data)
+			return hex.EncodeToString(sum[:])
+		}},
+		{"exactly one part", mb, func(data []byte) string {
+			return expectedETag(data, mb)
+		}},
+		{"multipart", 2*mb + mb/2, func(data []byte) string {
+			return expectedETag(data, mb)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("snowball"), tt.size/8+1)[:tt.size]
+			path := filepath.Join(dir, tt.name)
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LocalETag(path, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.want(data); got != want {
+				t.Errorf("LocalETag = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSameETag(t *testing.T) {
+	tests := []struct {
+		local, remote string
+		want          bool
+	}{
+		{"d41d8cd98f00b204e9800998ecf8427e", `"d41d8cd98f00b204e9800998ecf8427e"`, true},
+		{"d41d8cd98f00b204e9800998ecf8427e", "d41d8cd98f00b204e9800998ecf8427e", true},
+		{"0123456789abcdef0123456789abcdef-3", `"0123456789abcdef0123456789abcdef-3"`, true},
+		{"0123456789abcdef0123456789abcdef-3", `"0123456789abcdef0123456789abcdef-2"`, false},
+		{"d41d8cd98f00b204e9800998ecf8427e", `"d41d8cd98f00b204e9800998ecf8427e-1"`, false},
+	}
+	for _, tt := range tests {
+		if got := SameETag(tt.local, tt.remote); got != tt.want {
+			t.Errorf("SameETag(%s, %s) = %v, want %v", tt.local, tt.remote, got, tt.want)
+		}
+	}
+}
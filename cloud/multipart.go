@@ -0,0 +1,64 @@
+package cloud
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// MultipartUpload is a multipart upload started on the device and neither
+// completed nor aborted, with the parts it holds.
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+	Parts     int
+	Size      int64
+}
+
+// ListMultipartUploads returns the unfinished multipart uploads under
+// prefix. The parts of each are listed to count them and their bytes.
+func ListMultipartUploads(s3SVC *s3.S3, bucket, prefix string) ([]*MultipartUpload, error) {
+	var uploads []*MultipartUpload
+	input := &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	err := s3SVC.ListMultipartUploadsPages(input, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			uploads = append(uploads, &MultipartUpload{
+				Key:       aws.StringValue(u.Key),
+				UploadID:  aws.StringValue(u.UploadId),
+				Initiated: aws.TimeValue(u.Initiated),
+			})
+		}
+		return !lastPage
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, u := range uploads {
+		parts, err := listParts(s3SVC, bucket, u.Key, u.UploadID)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		u.Parts = len(parts)
+		for _, p := range parts {
+			u.Size += p.Size
+		}
+	}
+	return uploads, nil
+}
+
+// AbortMultipartUpload aborts the multipart upload uploadID of key, the
+// device freeing the parts it holds.
+func AbortMultipartUpload(s3SVC *s3.S3, bucket, key, uploadID string) error {
+	_, err := s3SVC.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	return errors.WithStack(err)
+}
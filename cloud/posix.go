@@ -0,0 +1,202 @@
+package cloud
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+)
+
+// The metadata keeping the POSIX metadata of a file with its object.
+const (
+	MtimeKey   = "snowball-mtime"
+	ModeKey    = "snowball-mode"
+	UIDKey     = "snowball-uid"
+	GIDKey     = "snowball-gid"
+	SymlinkKey = "snowball-symlink"
+	XattrsKey  = "snowball-xattrs"
+)
+
+// maxXattrsBytes keeps the encoded xattrs well under the 2KB of user
+// metadata an object can hold.
+const maxXattrsBytes = 1024
+
+// FileMetadata is the POSIX metadata of a file, a directory or a symlink.
+type FileMetadata struct {
+	ModTime time.Time
+	Mode    os.FileMode
+	// UID and GID are -1 when unknown.
+	UID     int
+	GID     int
+	Symlink string
+	Xattrs  map[string][]byte
+}
+
+// ReadFileMetadata returns the metadata of path, with its extended
+// attributes when xattrs is set. With links, a symlink is described
+// itself, with its target, else the file it points to is.
+func ReadFileMetadata(path string, xattrs, links bool) (*FileMetadata, error) {
+	stat := os.Stat
+	if links {
+		stat = os.Lstat
+	}
+	fi, err := stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m := &FileMetadata{ModTime: fi.ModTime(), Mode: fi.Mode()}
+	m.UID, m.GID = fileOwner(fi)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if m.Symlink, err = os.Readlink(path); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if xattrs {
+		if m.Xattrs, err = readXattrs(path, !links); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// unixMode returns the permission and special bits of mode as chmod takes
+// them.
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// Encode returns m as object metadata.
+func (m *FileMetadata) Encode() map[string]*string {
+	metadata := map[string]*string{
+		MtimeKey: aws.String(m.ModTime.UTC().Format(time.RFC3339Nano)),
+		ModeKey:  aws.String(strconv.FormatUint(uint64(unixMode(m.Mode)), 8)),
+	}
+	if m.UID >= 0 {
+		metadata[UIDKey] = aws.String(strconv.Itoa(m.UID))
+		metadata[GIDKey] = aws.String(strconv.Itoa(m.GID))
+	}
+	if m.Symlink != "" {
+		metadata[SymlinkKey] = aws.String(m.Symlink)
+	}
+	if len(m.Xattrs) > 0 {
+		data, err := json.Marshal(m.Xattrs)
+		if err == nil {
+			encoded := base64.StdEncoding.EncodeToString(data)
+			if len(encoded) <= maxXattrsBytes {
+				metadata[XattrsKey] = aws.String(encoded)
+			} else {
+				log.Printf("not keeping %d bytes of extended attributes, more than %d\n", len(encoded), maxXattrsBytes)
+			}
+		}
+	}
+	return metadata
+}
+
+// DecodeFileMetadata returns the file metadata kept in the metadata of an
+// object, or nil when there is none.
+func DecodeFileMetadata(metadata map[string]*string) (*FileMetadata, error) {
+	mtime := Metadata(metadata, MtimeKey)
+	if mtime == "" {
+		return nil, nil
+	}
+	m := &FileMetadata{UID: -1, GID: -1, Symlink: Metadata(metadata, SymlinkKey)}
+	var err error
+	if m.ModTime, err = time.Parse(time.RFC3339Nano, mtime); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", MtimeKey)
+	}
+	mode, err := strconv.ParseUint(Metadata(metadata, ModeKey), 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", ModeKey)
+	}
+	m.Mode = fileMode(uint32(mode))
+	if s := Metadata(metadata, UIDKey); s != "" {
+		if m.UID, err = strconv.Atoi(s); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", UIDKey)
+		}
+		if m.GID, err = strconv.Atoi(Metadata(metadata, GIDKey)); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", GIDKey)
+		}
+	}
+	if s := Metadata(metadata, XattrsKey); s != "" {
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err == nil {
+			err = json.Unmarshal(data, &m.Xattrs)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", XattrsKey)
+		}
+	}
+	return m, nil
+}
+
+// Apply sets m on path: its owner when allowed, its extended attributes,
+// its mode and last its modification time, which the others would change.
+// Symlinks only get their owner and extended attributes, their mode and
+// time being the ones of their target on most systems.
+func (m *FileMetadata) Apply(path string) error {
+	link := m.Symlink != ""
+	if m.UID >= 0 {
+		if err := os.Lchown(path, m.UID, m.GID); os.IsPermission(err) {
+			log.Printf("not restoring the owner of %s: %v\n", path, err)
+		} else if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for name, value := range m.Xattrs {
+		if err := setXattr(path, name, value); err != nil {
+			log.Printf("not restoring the attribute %s of %s: %v\n", name, path, err)
+		}
+	}
+	if link {
+		return nil
+	}
+	if err := os.Chmod(path, m.Mode); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Chtimes(path, m.ModTime, m.ModTime))
+}
+
+// restoreSymlink replaces path with a symlink to target.
+func restoreSymlink(path, target string) error {
+	if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(os.Symlink(target, path))
+}
+
+// markerKey returns the key of the marker object of a directory.
+func markerKey(key string) string {
+	return strings.TrimSuffix(key, "/") + "/"
+}
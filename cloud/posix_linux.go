@@ -0,0 +1,57 @@
+package cloud
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+func fileOwner(fi os.FileInfo) (int, int) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return -1, -1
+}
+
+// readXattrs returns the extended attributes of path, of the file a
+// symlink points to when follow is set.
+func readXattrs(path string, follow bool) (map[string][]byte, error) {
+	list, get := unix.Llistxattr, unix.Lgetxattr
+	if follow {
+		list, get = unix.Listxattr, unix.Getxattr
+	}
+	size, err := list(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing the attributes of %s", path)
+	}
+	names := make([]byte, size)
+	if size, err = list(path, names); err != nil {
+		return nil, errors.Wrapf(err, "listing the attributes of %s", path)
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		n, err := get(path, string(name), nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading the attribute %s of %s", name, path)
+		}
+		value := make([]byte, n)
+		if n, err = get(path, string(name), value); err != nil {
+			return nil, errors.Wrapf(err, "reading the attribute %s of %s", name, path)
+		}
+		xattrs[string(name)] = value[:n]
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
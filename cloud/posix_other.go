@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package cloud
+
+import (
+	"errors"
+	"os"
+)
+
+func fileOwner(fi os.FileInfo) (int, int) {
+	return -1, -1
+}
+
+func readXattrs(path string, follow bool) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are only supported on linux")
+}
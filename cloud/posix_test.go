@@ -0,0 +1,125 @@
+package cloud
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestFileMetadataEncode(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+	tests := []struct {
+		name string
+		m    FileMetadata
+	}{
+		{"file", FileMetadata{ModTime: mtime, Mode: 0644, UID: 1000, GID: 100}},
+		{"special bits", FileMetadata{ModTime: mtime, Mode: 0755 | os.ModeSetuid | os.ModeSetgid | os.ModeSticky,
+			UID: 0, GID: 0}},
+		{"unknown owner", FileMetadata{ModTime: mtime, Mode: 0600, UID: -1, GID: -1}},
+		{"symlink", FileMetadata{ModTime: mtime, Mode: 0777, UID: 0, GID: 0, Symlink: "../target dir/f"}},
+		{"xattrs", FileMetadata{ModTime: mtime, Mode: 0644, UID: -1, GID: -1,
+			Xattrs: map[string][]byte{"user.a": []byte("1"), "user.b": {0, 255}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeFileMetadata(tt.m.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.m) {
+				t.Errorf("decoded %+v, want %+v", *got, tt.m)
+			}
+		})
+	}
+
+	large := FileMetadata{ModTime: mtime, Mode: 0644, UID: -1, GID: -1,
+		Xattrs: map[string][]byte{"user.big": make([]byte, maxXattrsBytes)}}
+	if _, ok := large.Encode()[XattrsKey]; ok {
+		t.Errorf("xattrs of more than %d bytes kept", maxXattrsBytes)
+	}
+}
+
+func TestDecodeFileMetadata(t *testing.T) {
+	valid := (&FileMetadata{ModTime: time.Now(), Mode: 0644, UID: 1, GID: 2}).Encode()
+	with := func(key, value string) map[string]*string {
+		metadata := make(map[string]*string)
+		for k, v := range valid {
+			metadata[k] = v
+		}
+		metadata[key] = aws.String(value)
+		return metadata
+	}
+	tests := []struct {
+		name     string
+		metadata map[string]*string
+		err      string
+	}{
+		{"invalid mtime", with(MtimeKey, "yesterday"), MtimeKey},
+		{"invalid mode", with(ModeKey, "rw-r--r--"), ModeKey},
+		{"invalid uid", with(UIDKey, "root"), UIDKey},
+		{"invalid gid", with(GIDKey, ""), GIDKey},
+		{"invalid xattrs", with(XattrsKey, "not base64!"), XattrsKey},
+	}
+	for _, tt := range tests {
+		if _, err := DecodeFileMetadata(tt.metadata); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.err)
+		}
+	}
+	if m, err := DecodeFileMetadata(map[string]*string{SHA256Key: aws.String("sum")}); m != nil || err != nil {
+		t.Errorf("metadata of a plain object decoded as %+v, %v", m, err)
+	}
+}
+
+func TestFileMetadataApply(t *testing.T) {
+	dir := t.TempDir()
+	src := writeFile(t, dir, "src", []byte("data"))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chmod(src, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFileMetadata(src, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DecodeFileMetadata(read.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := writeFile(t, dir, "dst", []byte("data"))
+	if err := m.Apply(dst); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("applied mode %v and time %v, want %v and %v", fi.Mode().Perm(), fi.ModTime(), os.FileMode(0640),
+			mtime)
+	}
+
+	// a symlink leaves its target alone
+	link := filepath.Join(dir, "link")
+	if err := restoreSymlink(link, "src"); err != nil {
+		t.Fatal(err)
+	}
+	linkMeta := &FileMetadata{ModTime: time.Now(), Mode: 0777, UID: -1, GID: -1, Symlink: "src"}
+	if err := linkMeta.Apply(link); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(src); err != nil || fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("applying the metadata of a symlink changed its target: %v", err)
+	}
+	if target, err := os.Readlink(link); err != nil || target != "src" {
+		t.Errorf("symlink restored to %q, %v", target, err)
+	}
+}
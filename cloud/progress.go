@@ -0,0 +1,82 @@
+package cloud
+
+import (
+	"io"
+)
+
+// Progress is told the bytes of a transfer as they move, and takes them
+// back with a negative count when a body is read again from an earlier
+// point, to sign or retry its request. It may be nil.
+type Progress func(n int64)
+
+func (p Progress) add(n int64) {
+	if p != nil && n != 0 {
+		p(n)
+	}
+}
+
+// progressReader counts the bytes read from a request body. Bytes are only
+// counted once per position, so reading the body again after seeking back
+// takes back what was counted past the new position first.
+type progressReader struct {
+	r       io.ReadSeeker
+	base    int64
+	pos     int64
+	counted int64
+	p       Progress
+}
+
+func newProgressReader(r io.ReadSeeker, p Progress) (*progressReader, error) {
+	base, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &progressReader{r: r, base: base, p: p}, nil
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.pos += int64(n)
+	if r.pos > r.counted {
+		r.p.add(r.pos - r.counted)
+		r.counted = r.pos
+	}
+	return n, err
+}
+
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	abs, err := r.r.Seek(offset, whence)
+	if err != nil {
+		return abs, err
+	}
+	r.pos = abs - r.base
+	if r.pos < r.counted {
+		r.p.add(r.pos - r.counted)
+		r.counted = r.pos
+	}
+	return abs, nil
+}
+
+// countingReader counts the bytes read from a stream.
+type countingReader struct {
+	r io.Reader
+	p Progress
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.add(int64(n))
+	return n, err
+}
+
+// progressWriterAt counts the bytes written by a download.
+type progressWriterAt struct {
+	w io.WriterAt
+	p Progress
+}
+
+func (w progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := w.w.WriteAt(b, off)
+	w.p.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,422 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// UploadPart is a part already accepted by the device.
+type UploadPart struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// UploadState is the local record of an in-flight multipart upload, saved
+// after every completed part so a later run can pick it up.
+type UploadState struct {
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Src      string    `json:"src"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	PartSize int64     `json:"part_size"`
+	UploadID string    `json:"upload_id"`
+	// SHA256 is the one of the file stored as metadata of the upload.
+	SHA256 string       `json:"sha256,omitempty"`
+	Parts  []UploadPart `json:"parts"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// PartBytes returns the part size in bytes s3manager would use for a file of
+// size bytes with a configured part size in MB, growing it when the file
+// would otherwise need more than s3manager.MaxUploadParts parts.
+func PartBytes(size, partSize int64) int64 {
+	n := partSize * 1024 * 1024
+	if size/n >= s3manager.MaxUploadParts {
+		n = size/s3manager.MaxUploadParts + 1
+	}
+	return n
+}
+
+func statePath(stateDir, bucket, key string) string {
+	sum := sha1.Sum([]byte(bucket + "/" + key))
+	return filepath.Join(stateDir, "uploads", hex.EncodeToString(sum[:])+".json")
+}
+
+// loadUploadState reads the saved state for bucket/key. It returns nil when
+// there is none or when it was written for a different version of src.
+func loadUploadState(stateDir, bucket, key, src string, fi os.FileInfo, partBytes int64) *UploadState {
+	path := statePath(stateDir, bucket, key)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	state := &UploadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		log.Printf("ignoring corrupt upload state %s: %v\n", path, err)
+		return nil
+	}
+	state.path = path
+	if state.Src != src || state.Size != fi.Size() || !state.ModTime.Equal(fi.ModTime()) ||
+		state.PartSize != partBytes {
+		return nil
+	}
+	return state
+}
+
+func (s *UploadState) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, s.path))
+}
+
+func (s *UploadState) remove() {
+	os.Remove(s.path)
+}
+
+func (s *UploadState) addPart(part UploadPart) error {
+	s.mu.Lock()
+	s.Parts = append(s.Parts, part)
+	s.mu.Unlock()
+	return s.save()
+}
+
+// listParts returns the parts the device holds of the multipart upload
+// uploadID of key.
+func listParts(s3SVC *s3.S3, bucket, key, uploadID string) ([]UploadPart, error) {
+	var parts []UploadPart
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	err := s3SVC.ListPartsPages(input, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, p := range page.Parts {
+			parts = append(parts, UploadPart{
+				Number: aws.Int64Value(p.PartNumber),
+				ETag:   aws.StringValue(p.ETag),
+				Size:   aws.Int64Value(p.Size),
+			})
+		}
+		return !lastPage
+	})
+	return parts, err
+}
+
+// remoteParts asks the device which parts of the upload it already holds.
+func remoteParts(s3SVC *s3.S3, state *UploadState) ([]UploadPart, error) {
+	return listParts(s3SVC, state.Bucket, state.Key, state.UploadID)
+}
+
+// SavedUploadID returns the id of the multipart upload of bucket/key whose
+// state is kept under stateDir, to be resumed by the next upload of the
+// key, or "" when there is none.
+func SavedUploadID(stateDir, bucket, key string) string {
+	data, err := ioutil.ReadFile(statePath(stateDir, bucket, key))
+	if err != nil {
+		return ""
+	}
+	state := &UploadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return ""
+	}
+	return state.UploadID
+}
+
+// abortSavedUpload aborts the multipart upload of bucket/key whose state is
+// kept under stateDir, if any, and removes the state. An upload the device
+// no longer has is not an error.
+func abortSavedUpload(s3SVC *s3.S3, stateDir, bucket, key string) error {
+	uploadID := SavedUploadID(stateDir, bucket, key)
+	if uploadID == "" {
+		return nil
+	}
+	log.Printf("aborting upload %s of %s, saved for another version of the file\n", uploadID, key)
+	err := AbortMultipartUpload(s3SVC, bucket, key, uploadID)
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(statePath(stateDir, bucket, key))
+	return nil
+}
+
+// filePart is a part of a file read for upload, with its MD5 when known.
+type filePart struct {
+	number int64
+	data   []byte
+	md5    string
+}
+
+// resumableUpload uploads src as a multipart upload whose progress is kept
+// under StateDir. When a previous run left an upload for the same file, the
+// parts the device already has are skipped.
+//
+// The file is read once, in order, a part at a time, each part being sent
+// by one of Concurrency workers; at most Concurrency+1 parts are held in
+// memory. A part the device already has is hashed and kept when its ETag
+// is the MD5 of the local bytes. With full checksums each part is sent
+// with its Content-MD5 and the ETag of the object is checked against the
+// local parts. The metadata of a multipart upload is set when it is
+// created, so the SHA-256 stored in it is read in a first pass, not
+// reported to progress, and checked against the one of the parts sent
+// before the upload is completed.
+func (t *transfer) resumableUpload(bucket, src, dst string) (*Result, error) {
+	file, err := os.Open(src)
+	if err != nil {
+		return t.result, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	totalSize := fi.Size()
+	partBytes := PartBytes(totalSize, t.opts.PartSize)
+	numParts := (totalSize + partBytes - 1) / partBytes
+	threads := t.opts.Concurrency
+	progress := t.progress()
+
+	onDevice := make(map[int64]UploadPart)
+	state := loadUploadState(t.opts.StateDir, bucket, dst, src, fi, partBytes)
+	if state != nil {
+		parts, err := remoteParts(t.S3, state)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			state.remove()
+			state = nil
+		} else if err != nil {
+			return t.result, errors.WithStack(err)
+		} else {
+			for _, p := range parts {
+				onDevice[p.Number] = p
+			}
+			log.Printf("resuming upload of %s, %d parts on the device\n", src, len(onDevice))
+		}
+	}
+	if state == nil {
+		// the upload saved for another version of src would hold its parts forever
+		if err := abortSavedUpload(t.S3, t.opts.StateDir, bucket, dst); err != nil {
+			return t.result, err
+		}
+		var sum string
+		metadata := t.metadata(nil)
+		if t.checked() {
+			if sum, err = FileSHA256(src); err != nil {
+				return t.result, err
+			}
+			metadata[SHA256Key] = aws.String(sum)
+		}
+		out, err := t.S3.CreateMultipartUploadWithContext(aws.BackgroundContext(), &s3.CreateMultipartUploadInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(dst),
+			StorageClass: t.storageClass(),
+			Metadata:     metadata,
+		}, t.request)
+		if err != nil {
+			return t.result, errors.WithStack(err)
+		}
+		state = &UploadState{
+			Bucket:   bucket,
+			Key:      dst,
+			Src:      src,
+			Size:     totalSize,
+			ModTime:  fi.ModTime(),
+			PartSize: partBytes,
+			UploadID: *out.UploadId,
+			SHA256:   sum,
+			path:     statePath(t.opts.StateDir, bucket, dst),
+		}
+	}
+	// the parts are recorded again as they are found on the device or sent
+	state.Parts = nil
+	if err := state.save(); err != nil {
+		return t.result, err
+	}
+
+	parts := make(chan filePart)
+	// the buffers of the parts, allocated when first needed
+	free := make(chan []byte, threads+1)
+	for i := 0; i <= threads; i++ {
+		free <- nil
+	}
+	errs := make(chan error, threads)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				body, err := newProgressReader(bytes.NewReader(part.data), progress)
+				if err != nil {
+					errs <- errors.WithStack(err)
+					return
+				}
+				input := &s3.UploadPartInput{
+					Bucket:     aws.String(bucket),
+					Key:        aws.String(dst),
+					UploadId:   aws.String(state.UploadID),
+					PartNumber: aws.Int64(part.number),
+					Body:       body,
+				}
+				if part.md5 != "" {
+					input.ContentMD5 = aws.String(contentMD5(part.md5))
+				}
+				out, err := t.S3.UploadPartWithContext(aws.BackgroundContext(), input, t.request)
+				if err == nil {
+					err = state.addPart(UploadPart{Number: part.number, ETag: aws.StringValue(out.ETag),
+						Size: int64(len(part.data))})
+				}
+				if err != nil {
+					errs <- errors.Wrapf(err, "part %d of %s", part.number, src)
+					return
+				}
+				free <- part.data
+			}
+		}()
+	}
+
+	whole := sha256.New()
+	md5s := make([]string, numParts)
+	var resumed int
+	var uploadErr error
+	for num := int64(1); num <= numParts && uploadErr == nil; num++ {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case uploadErr = <-errs:
+			continue
+		}
+		size := partBytes
+		if num == numParts {
+			size = totalSize - (num-1)*partBytes
+		}
+		if buf == nil {
+			buf = make([]byte, partBytes)
+		}
+		buf = buf[:size]
+		if _, err := io.ReadFull(file, buf); err != nil {
+			uploadErr = errors.Wrapf(err, "%s changed while uploading", src)
+			break
+		}
+		if t.checked() {
+			whole.Write(buf)
+		}
+		remote, ok := onDevice[num]
+		if t.checked() || ok {
+			sum := md5.Sum(buf)
+			md5s[num-1] = hex.EncodeToString(sum[:])
+		}
+		// a part is kept only when the device has exactly the local bytes
+		if ok && remote.Size == size && SameETag(md5s[num-1], remote.ETag) {
+			state.mu.Lock()
+			state.Parts = append(state.Parts, remote)
+			state.mu.Unlock()
+			progress.add(size)
+			resumed++
+			free <- buf
+			continue
+		}
+		part := filePart{number: num, data: buf}
+		if t.checked() {
+			part.md5 = md5s[num-1]
+		}
+		select {
+		case parts <- part:
+		case uploadErr = <-errs:
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if uploadErr == nil && len(errs) > 0 {
+		uploadErr = <-errs
+	}
+	if uploadErr != nil {
+		// The state is kept so the next run resumes from the parts already sent.
+		log.Println("Error:", uploadErr, state.UploadID)
+		if err := state.save(); err != nil {
+			log.Println(err)
+		}
+		return t.result, uploadErr
+	}
+	if resumed > 0 {
+		log.Printf("%d parts of %s already on the device\n", resumed, src)
+	}
+	if t.checked() {
+		t.result.SHA256 = hex.EncodeToString(whole.Sum(nil))
+		if state.SHA256 != "" && state.SHA256 != t.result.SHA256 {
+			// the SHA-256 stored would not be the one of the object
+			state.remove()
+			if err := AbortMultipartUpload(t.S3, bucket, dst, state.UploadID); err != nil {
+				log.Println(err)
+			}
+			return t.result, errors.Errorf("%s changed while uploading", src)
+		}
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool {
+		return state.Parts[i].Number < state.Parts[j].Number
+	})
+	completed := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for _, p := range state.Parts {
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(p.Number),
+		})
+	}
+	result, err := t.S3.CompleteMultipartUploadWithContext(aws.BackgroundContext(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(dst),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	}, t.request)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	state.remove()
+	t.result.ETag = aws.StringValue(result.ETag)
+	if t.checked() {
+		sums := &FileSums{PartSize: partBytes, PartMD5s: md5s}
+		if etag := sums.multipartETag(); !SameETag(etag, t.result.ETag) {
+			return t.result, &ChecksumError{Key: dst, Local: etag, Remote: t.result.ETag}
+		}
+	}
+
+	t.result.Location = aws.StringValue(result.Location)
+	t.result.Parts = numParts
+	return t.done(totalSize), nil
+}
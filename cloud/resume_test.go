@@ -0,0 +1,188 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+const mb = 1024 * 1024
+
+func TestResumableUpload(t *testing.T) {
+	data := randomBytes(2*mb + 100)
+	tests := []struct {
+		name string
+		// device returns the parts the device holds of the saved upload,
+		// nil for no saved upload
+		device [][]byte
+		// stale saves the upload for another version of the file
+		stale   bool
+		gone    bool
+		sent    int
+		created int
+		aborted int
+	}{
+		{"no saved upload", nil, false, false, 3, 1, 0},
+		{"resumed", [][]byte{data[:mb]}, false, false, 2, 0, 0},
+		{"resumed with every part", [][]byte{data[:mb], data[mb : 2*mb], data[2*mb:]}, false, false, 0, 0, 0},
+		{"part on the device differs", [][]byte{data[1 : mb+1]}, false, false, 3, 0, 0},
+		{"upload gone from the device", [][]byte{data[:mb]}, false, true, 3, 1, 0},
+		{"saved for another version", [][]byte{data[:mb]}, true, false, 3, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv := testEngine(t)
+			dir := t.TempDir()
+			src := writeFile(t, dir, "src", data)
+			opts := Options{PartSize: 1, Concurrency: 2, StateDir: dir}
+			if tt.device != nil {
+				fi, err := os.Stat(src)
+				if err != nil {
+					t.Fatal(err)
+				}
+				state := &UploadState{Bucket: testBucket, Key: "dst", Src: src, Size: fi.Size(),
+					ModTime: fi.ModTime(), PartSize: mb, UploadID: "gone",
+					path: statePath(dir, testBucket, "dst")}
+				if !tt.gone {
+					state.UploadID = srv.StartUpload(testBucket, "dst", time.Now(), tt.device...)
+				}
+				if tt.stale {
+					state.ModTime = state.ModTime.Add(-time.Hour)
+				}
+				if err := state.save(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := e.Upload(testBucket, src, "dst", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if obj := srv.Object(testBucket, "dst"); obj == nil || !bytes.Equal(obj.Data, data) {
+				t.Fatal("object differs from the file")
+			}
+			if result.Parts != 3 || result.Size != int64(len(data)) {
+				t.Errorf("result of %d parts of %d bytes", result.Parts, result.Size)
+			}
+			if n := srv.Requests("UploadPart"); n != tt.sent {
+				t.Errorf("%d parts sent, want %d", n, tt.sent)
+			}
+			if n := srv.Requests("CreateMultipartUpload"); n != tt.created {
+				t.Errorf("%d uploads created, want %d", n, tt.created)
+			}
+			if n := srv.Requests("AbortMultipartUpload"); n != tt.aborted {
+				t.Errorf("%d uploads aborted, want %d", n, tt.aborted)
+			}
+			if uploads := srv.Uploads(testBucket); len(uploads) != 0 {
+				t.Errorf("%d uploads left on the device", len(uploads))
+			}
+			if _, err := os.Stat(statePath(dir, testBucket, "dst")); !os.IsNotExist(err) {
+				t.Errorf("upload state left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestResumableUploadAfterFailure(t *testing.T) {
+	e, srv := testEngine(t)
+	dir := t.TempDir()
+	data := randomBytes(3 * mb)
+	src := writeFile(t, dir, "src", data)
+	opts := Options{PartSize: 1, Concurrency: 1, StateDir: dir}
+	// the device stores something else than the second part
+	srv.Tamper = func(key string, part int64, data []byte) []byte {
+		if part == 2 {
+			data[0] ^= 1
+		}
+		return data
+	}
+	if _, err := e.Upload(testBucket, src, "dst", opts); err == nil {
+		t.Fatal("upload of a part stored wrong succeeded")
+	}
+	if SavedUploadID(dir, testBucket, "dst") == "" {
+		t.Fatal("no upload state kept after the failure")
+	}
+
+	srv.Tamper = nil
+	sent := srv.Requests("UploadPart")
+	if _, err := e.Upload(testBucket, src, "dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	if obj := srv.Object(testBucket, "dst"); obj == nil || !bytes.Equal(obj.Data, data) {
+		t.Fatal("object differs from the file")
+	}
+	// the first part is kept, the second stored wrong is sent again
+	if n := srv.Requests("UploadPart") - sent; n != 2 {
+		t.Errorf("%d parts sent when resuming, want 2", n)
+	}
+	if n := srv.Requests("CreateMultipartUpload"); n != 1 {
+		t.Errorf("%d uploads created, want 1", n)
+	}
+}
+
+func TestResumableUploadSHA256(t *testing.T) {
+	data := randomBytes(2*mb + 100)
+	sum := sha256.Sum256(data)
+	tests := []struct {
+		checksum ChecksumMode
+		want     string
+	}{
+		{ChecksumFull, hex.EncodeToString(sum[:])},
+		{ChecksumNone, ""},
+	}
+	for _, tt := range tests {
+		e, srv := testEngine(t)
+		dir := t.TempDir()
+		src := writeFile(t, dir, "src", data)
+		opts := Options{PartSize: 1, Concurrency: 2, StateDir: dir, Checksum: tt.checksum}
+		result, err := e.Upload(testBucket, src, "dst", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := srv.Object(testBucket, "dst")
+		if obj == nil {
+			t.Fatal("no object stored")
+		}
+		if got := obj.Metadata[http.CanonicalHeaderKey(SHA256Key)]; got != tt.want {
+			t.Errorf("%s: SHA-256 metadata %q, want %q", tt.checksum, got, tt.want)
+		}
+		if result.SHA256 != tt.want {
+			t.Errorf("%s: SHA-256 of the result %q, want %q", tt.checksum, result.SHA256, tt.want)
+		}
+	}
+}
+
+func TestResumableUploadChanged(t *testing.T) {
+	e, srv := testEngine(t)
+	dir := t.TempDir()
+	data := randomBytes(2*mb + 100)
+	src := writeFile(t, dir, "src", data)
+	fi, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the upload was created for the file before it changed in place
+	state := &UploadState{Bucket: testBucket, Key: "dst", Src: src, Size: fi.Size(),
+		ModTime: fi.ModTime(), PartSize: mb, SHA256: "0123",
+		UploadID: srv.StartUpload(testBucket, "dst", time.Now(), data[:mb]),
+		path:     statePath(dir, testBucket, "dst")}
+	if err := state.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Upload(testBucket, src, "dst", Options{PartSize: 1, Concurrency: 2, StateDir: dir}); err == nil {
+		t.Fatal("upload of a changed file succeeded")
+	}
+	if srv.Object(testBucket, "dst") != nil {
+		t.Error("object stored with the SHA-256 of another file")
+	}
+	if uploads := srv.Uploads(testBucket); len(uploads) != 0 {
+		t.Errorf("%d uploads left on the device", len(uploads))
+	}
+	if SavedUploadID(dir, testBucket, "dst") != "" {
+		t.Error("upload state left behind")
+	}
+}
@@ -0,0 +1,585 @@
+// Package s3test runs an in-memory S3 server holding just enough of the
+// API for the tests of the packages talking to the device.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const metaPrefix = "X-Amz-Meta-"
+
+// Object is an object stored by the server. Its metadata is keyed by the
+// canonical header names without their X-Amz-Meta- prefix, as the SDK
+// returns them.
+type Object struct {
+	Data     []byte
+	ETag     string
+	Metadata map[string]string
+	Modified time.Time
+	// PartSizes are the sizes of the parts of an object stored by a
+	// multipart upload.
+	PartSizes []int64
+}
+
+// Upload is a multipart upload neither completed nor aborted.
+type Upload struct {
+	Bucket    string
+	Key       string
+	ID        string
+	Initiated time.Time
+	Metadata  map[string]string
+	Parts     map[int64][]byte
+}
+
+// Server is an S3 endpoint serving its buckets from memory.
+type Server struct {
+	URL string
+	// Tamper, when set, changes the bytes of an object, or of part number
+	// part of its multipart upload, as they are stored, the ETag being the
+	// MD5 of what is stored.
+	Tamper func(key string, part int64, data []byte) []byte
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]*Object
+	uploads  map[string]*Upload
+	requests map[string]int
+	nextID   int
+	srv      *httptest.Server
+}
+
+// NewServer starts a server holding the empty buckets named.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		buckets:  make(map[string]map[string]*Object),
+		uploads:  make(map[string]*Upload),
+		requests: make(map[string]int),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string]*Object)
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Client returns an S3 client of the server, which does not retry.
+func (s *Server) Client() *s3.S3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials("id", "key", ""),
+		Endpoint:         aws.String(s.URL),
+		Region:           aws.String("snow"),
+		DisableSSL:       aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	}))
+	return s3.New(sess)
+}
+
+// Object returns a copy of the object key of bucket, nil when there is
+// none.
+func (s *Server) Object(bucket, key string) *Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil
+	}
+	c := *o
+	c.Data = append([]byte(nil), o.Data...)
+	return &c
+}
+
+// Keys returns the sorted keys of the objects of bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PutObject stores data as the object key of bucket, with metadata.
+func (s *Server) PutObject(bucket, key string, data []byte, metadata map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = &Object{Data: data, ETag: md5Hex(data), Metadata: metadata, Modified: time.Now()}
+}
+
+// Corrupt flips the byte at off of the object key of bucket, leaving its
+// ETag, as a fault of the storage would.
+func (s *Server) Corrupt(bucket, key string, off int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key].Data[off] ^= 1
+}
+
+// Uploads returns the unfinished multipart uploads of bucket.
+func (s *Server) Uploads(bucket string) []*Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var uploads []*Upload
+	for _, u := range s.uploads {
+		if u.Bucket == bucket {
+			uploads = append(uploads, u)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].ID < uploads[j].ID })
+	return uploads
+}
+
+// StartUpload starts a multipart upload of key initiated at initiated,
+// holding parts numbered from 1, and returns its id.
+func (s *Server) StartUpload(bucket, key string, initiated time.Time, parts ...[]byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.newUpload(bucket, key, nil)
+	u.Initiated = initiated
+	for i, p := range parts {
+		u.Parts[int64(i+1)] = p
+	}
+	return u.ID
+}
+
+// Requests returns the number of requests of operation, named as in the
+// S3 API, the server received.
+func (s *Server) Requests(operation string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[operation]
+}
+
+func (s *Server) newUpload(bucket, key string, metadata map[string]string) *Upload {
+	s.nextID++
+	u := &Upload{Bucket: bucket, Key: key, ID: fmt.Sprintf("upload-%d", s.nextID), Initiated: time.Now(),
+		Metadata: metadata, Parts: make(map[int64][]byte)}
+	s.uploads[u.ID] = u
+	return u
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func metadata(h http.Header) map[string]string {
+	m := make(map[string]string)
+	for k := range h {
+		if strings.HasPrefix(k, metaPrefix) {
+			m[strings.TrimPrefix(k, metaPrefix)] = h.Get(k)
+		}
+	}
+	return m
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	data, err := xml.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	objects, ok := s.buckets[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if digest := r.Header.Get("Content-Md5"); digest != "" {
+		sum, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil || hex.EncodeToString(sum) != md5Hex(body) {
+			writeError(w, http.StatusBadRequest, "BadDigest")
+			return
+		}
+	}
+	q := r.URL.Query()
+	if len(path) == 1 || path[1] == "" {
+		s.serveBucket(w, r, path[0], objects, body)
+		return
+	}
+	key := path[1]
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		s.copy(w, r, objects, key)
+	case r.Method == http.MethodPut && uploadID != "":
+		s.requests["UploadPart"]++
+		u, ok := s.uploads[uploadID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		num, _ := strconv.ParseInt(q.Get("partNumber"), 10, 64)
+		u.Parts[num] = s.tamper(key, num, body)
+		w.Header().Set("ETag", `"`+md5Hex(u.Parts[num])+`"`)
+	case r.Method == http.MethodPut:
+		s.requests["PutObject"]++
+		data := s.tamper(key, 0, body)
+		objects[key] = &Object{Data: data, ETag: md5Hex(data), Metadata: metadata(r.Header), Modified: time.Now()}
+		w.Header().Set("ETag", `"`+objects[key].ETag+`"`)
+	case r.Method == http.MethodPost && uploads:
+		s.requests["CreateMultipartUpload"]++
+		u := s.newUpload(path[0], key, metadata(r.Header))
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: path[0], Key: key, UploadId: u.ID})
+	case r.Method == http.MethodPost && uploadID != "":
+		s.requests["CompleteMultipartUpload"]++
+		s.complete(w, r, objects, key, uploadID, body)
+	case r.Method == http.MethodDelete && uploadID != "":
+		s.requests["AbortMultipartUpload"]++
+		if _, ok := s.uploads[uploadID]; !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		delete(s.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		s.requests["DeleteObject"]++
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && uploadID != "":
+		s.requests["ListParts"]++
+		s.listParts(w, uploadID)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.get(w, r, objects, key)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) tamper(key string, part int64, data []byte) []byte {
+	if s.Tamper == nil {
+		return data
+	}
+	return s.Tamper(key, part, append([]byte(nil), data...))
+}
+
+func (s *Server) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*Object,
+	body []byte) {
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	_, del := q["delete"]
+	switch {
+	case r.Method == http.MethodGet && uploads:
+		s.requests["ListMultipartUploads"]++
+		type entry struct {
+			Key       string
+			UploadId  string
+			Initiated string
+		}
+		out := struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket      string
+			IsTruncated bool
+			Upload      []entry
+		}{Bucket: bucket}
+		for _, u := range s.uploads {
+			if u.Bucket == bucket && strings.HasPrefix(u.Key, q.Get("prefix")) {
+				out.Upload = append(out.Upload, entry{u.Key, u.ID, u.Initiated.UTC().Format(time.RFC3339)})
+			}
+		}
+		sort.Slice(out.Upload, func(i, j int) bool { return out.Upload[i].UploadId < out.Upload[j].UploadId })
+		writeXML(w, out)
+	case r.Method == http.MethodGet:
+		s.requests["ListObjects"]++
+		s.list(w, r, bucket, objects)
+	case r.Method == http.MethodPost && del:
+		s.requests["DeleteObjects"]++
+		var in struct {
+			Object []struct{ Key string }
+		}
+		if err := xml.Unmarshal(body, &in); err != nil {
+			writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		type deleted struct{ Key string }
+		out := struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+			Deleted []deleted
+		}{}
+		for _, o := range in.Object {
+			delete(objects, o.Key)
+			out.Deleted = append(out.Deleted, deleted{o.Key})
+		}
+		writeXML(w, out)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, bucket string, objects map[string]*Object) {
+	q := r.URL.Query()
+	prefix, marker := q.Get("prefix"), q.Get("marker")
+	max := 1000
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n > 0 {
+		max = n
+	}
+	var keys []string
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) && k > marker {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	out := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		Marker      string
+		IsTruncated bool
+		NextMarker  string `xml:",omitempty"`
+		Contents    []content
+	}{Name: bucket, Prefix: prefix, Marker: marker}
+	if len(keys) > max {
+		keys = keys[:max]
+		out.IsTruncated = true
+		out.NextMarker = keys[max-1]
+	}
+	for _, k := range keys {
+		o := objects[k]
+		out.Contents = append(out.Contents, content{k, o.Modified.UTC().Format(time.RFC3339), `"` + o.ETag + `"`,
+			len(o.Data)})
+	}
+	writeXML(w, out)
+}
+
+func (s *Server) listParts(w http.ResponseWriter, uploadID string) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	type part struct {
+		PartNumber int64
+		ETag       string
+		Size       int
+	}
+	out := struct {
+		XMLName     xml.Name `xml:"ListPartsResult"`
+		IsTruncated bool
+		Part        []part
+	}{}
+	for num, data := range u.Parts {
+		out.Part = append(out.Part, part{num, `"` + md5Hex(data) + `"`, len(data)})
+	}
+	sort.Slice(out.Part, func(i, j int) bool { return out.Part[i].PartNumber < out.Part[j].PartNumber })
+	writeXML(w, out)
+}
+
+func (s *Server) complete(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key, uploadID string,
+	body []byte) {
+	u, ok := s.uploads[uploadID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var in struct {
+		Part []struct {
+			PartNumber int64
+			ETag       string
+		}
+	}
+	if err := xml.Unmarshal(body, &in); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data, sums []byte
+	var sizes []int64
+	for _, p := range in.Part {
+		part, ok := u.Parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != md5Hex(part) {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data = append(data, part...)
+		sizes = append(sizes, int64(len(part)))
+		sum := md5.Sum(part)
+		sums = append(sums, sum[:]...)
+	}
+	etag := fmt.Sprintf("%s-%d", md5Hex(sums), len(in.Part))
+	objects[key] = &Object{Data: data, ETag: etag, Metadata: u.Metadata, Modified: time.Now(), PartSizes: sizes}
+	delete(s.uploads, uploadID)
+	writeXML(w, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Location: s.URL + r.URL.Path, Bucket: u.Bucket, Key: key, ETag: `"` + etag + `"`})
+}
+
+// copy serves CopyObject and UploadPartCopy. The source is the bucket and
+// the key of the object, each escaped, separated by a slash.
+func (s *Server) copy(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	path := strings.SplitN(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"), "/", 2)
+	if len(path) != 2 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	bucket, err := url.PathUnescape(path[0])
+	if err == nil {
+		path[1], err = url.PathUnescape(path[1])
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	o, ok := s.buckets[bucket][path[1]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	q := r.URL.Query()
+	if uploadID := q.Get("uploadId"); uploadID != "" {
+		s.requests["UploadPartCopy"]++
+		u, ok := s.uploads[uploadID]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err != nil ||
+			start > end || end >= len(o.Data) {
+			writeError(w, http.StatusBadRequest, "InvalidRange")
+			return
+		}
+		num, _ := strconv.ParseInt(q.Get("partNumber"), 10, 64)
+		u.Parts[num] = append([]byte(nil), o.Data[start:end+1]...)
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CopyPartResult"`
+			ETag    string
+		}{ETag: `"` + md5Hex(u.Parts[num]) + `"`})
+		return
+	}
+	s.requests["CopyObject"]++
+	meta := o.Metadata
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		meta = metadata(r.Header)
+	}
+	objects[key] = &Object{Data: o.Data, ETag: o.ETag, Metadata: meta, Modified: time.Now(), PartSizes: o.PartSizes}
+	writeXML(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string
+	}{ETag: `"` + o.ETag + `"`})
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, objects map[string]*Object, key string) {
+	if r.Method == http.MethodHead {
+		s.requests["HeadObject"]++
+	} else {
+		s.requests["GetObject"]++
+	}
+	o, ok := objects[key]
+	if !ok {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil &&
+		o.Modified.Truncate(time.Second).After(since) {
+		writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	for k, v := range o.Metadata {
+		w.Header().Set(metaPrefix+k, v)
+	}
+	w.Header().Set("ETag", `"`+o.ETag+`"`)
+	w.Header().Set("Last-Modified", o.Modified.UTC().Format(http.TimeFormat))
+	data := o.Data
+	status := http.StatusOK
+	if num, err := strconv.Atoi(r.URL.Query().Get("partNumber")); err == nil && len(o.PartSizes) > 0 {
+		// a part of an object stored by a multipart upload
+		if num < 1 || num > len(o.PartSizes) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidPartNumber")
+			return
+		}
+		var start int64
+		for _, size := range o.PartSizes[:num-1] {
+			start += size
+		}
+		end := start + o.PartSizes[num-1]
+		w.Header().Set("X-Amz-Mp-Parts-Count", strconv.Itoa(len(o.PartSizes)))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(data)))
+		data = data[start:end]
+		status = http.StatusPartialContent
+	} else if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		start, _ := strconv.Atoi(bounds[0])
+		end := len(data) - 1
+		if len(bounds) == 2 && bounds[1] != "" {
+			end, _ = strconv.Atoi(bounds[1])
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		if start > end {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		bytes.NewReader(data).WriteTo(w)
+	}
+}
@@ -0,0 +1,84 @@
+package cloud
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// Window is a daily time window with its bandwidth limit. Start and End are
+// the time since midnight; a window with End before Start spans midnight.
+type Window struct {
+	Start  time.Duration
+	End    time.Duration
+	Rate   int64
+	Paused bool
+}
+
+// Schedule is a list of windows, the first one matching wins.
+type Schedule []Window
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseSchedule parses windows written "HH:MM-HH:MM limit", where limit is
+// a rate for ParseRate or "paused".
+func ParseSchedule(entries []string) (Schedule, error) {
+	var schedule Schedule
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid schedule window %q, expected \"HH:MM-HH:MM limit\"", entry)
+		}
+		bounds := strings.Split(fields[0], "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid schedule window %q, expected \"HH:MM-HH:MM limit\"", entry)
+		}
+		var w Window
+		var err error
+		if w.Start, err = parseClock(bounds[0]); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(bounds[1]); err != nil {
+			return nil, err
+		}
+		if w.Rate, w.Paused, err = ParseLimit(fields[1]); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, w)
+	}
+	return schedule, nil
+}
+
+func (w Window) contains(clock time.Duration) bool {
+	if w.Start <= w.End {
+		return clock >= w.Start && clock < w.End
+	}
+	return clock >= w.Start || clock < w.End
+}
+
+// At returns the window of s holding t, in the local time zone.
+func (s Schedule) At(t time.Time) (Window, bool) {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	for _, w := range s {
+		if w.contains(clock) {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
+
+// HoldRequest is a Sign handler making new requests, parts included, wait
+// while Bandwidth is paused. It runs before signing so a long pause does
+// not leave the request with an expired signature.
+func HoldRequest(r *request.Request) {
+	Bandwidth.Hold()
+}
@@ -0,0 +1,79 @@
+package cloud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		entries []string
+		want    Schedule
+		err     bool
+	}{
+		{nil, nil, false},
+		{[]string{"08:00-18:00 10MB/s"}, Schedule{{8 * time.Hour, 18 * time.Hour, 10 * 1024 * 1024, false}}, false},
+		{[]string{"22:30-06:00 off", "12:00-13:00 paused"}, Schedule{
+			{22*time.Hour + 30*time.Minute, 6 * time.Hour, 0, false},
+			{12 * time.Hour, 13 * time.Hour, 0, true},
+		}, false},
+		{[]string{"08:00-18:00"}, nil, true},
+		{[]string{"08:00 18:00 1M"}, nil, true},
+		{[]string{"8h-18h 1M"}, nil, true},
+		{[]string{"08:00-24:00 1M"}, nil, true},
+		{[]string{"08:00-18:00 fast"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSchedule(tt.entries)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseSchedule(%q) error = %v, want error %v", tt.entries, err, tt.err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseSchedule(%q) = %v, want %v", tt.entries, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseSchedule(%q)[%d] = %v, want %v", tt.entries, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	schedule, err := ParseSchedule([]string{"22:00-06:00 100MB/s", "09:00-17:00 paused", "06:00-06:00 1M"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		clock string
+		ok    bool
+		want  int
+	}{
+		{"21:59:59", false, 0},
+		{"22:00:00", true, 0},
+		{"23:59:59", true, 0},
+		{"00:00:00", true, 0},
+		{"05:59:59", true, 0},
+		{"06:00:00", false, 0},
+		{"08:59:59", false, 0},
+		{"09:00:00", true, 1},
+		{"16:59:59", true, 1},
+		{"17:00:00", false, 0},
+	}
+	for _, tt := range tests {
+		at, err := time.ParseInLocation("15:04:05", tt.clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, ok := schedule.At(at)
+		if ok != tt.ok {
+			t.Errorf("At(%s) found %v, want %v", tt.clock, ok, tt.ok)
+			continue
+		}
+		if ok && w != schedule[tt.want] {
+			t.Errorf("At(%s) = %v, want %v", tt.clock, w, schedule[tt.want])
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+)
+
+// partHasher hashes a stream as it goes by, keeping the MD5 of each part of
+// size bytes and the SHA-256 of the whole stream.
+type partHasher struct {
+	sums  *FileSums
+	part  hash.Hash
+	n     int64
+	whole hash.Hash
+	total int64
+}
+
+func newPartHasher(size int64) *partHasher {
+	return &partHasher{sums: &FileSums{PartSize: size}, part: md5.New(), whole: sha256.New()}
+}
+
+func (p *partHasher) Write(b []byte) (int, error) {
+	written := len(b)
+	p.whole.Write(b)
+	p.total += int64(len(b))
+	for len(b) > 0 {
+		chunk := b
+		if left := p.sums.PartSize - p.n; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		p.part.Write(chunk)
+		p.n += int64(len(chunk))
+		b = b[len(chunk):]
+		if p.n == p.sums.PartSize {
+			p.sums.PartMD5s = append(p.sums.PartMD5s, hex.EncodeToString(p.part.Sum(nil)))
+			p.part.Reset()
+			p.n = 0
+		}
+	}
+	return written, nil
+}
+
+// finish returns the checksums of the stream read so far.
+func (p *partHasher) finish() *FileSums {
+	if p.n > 0 || len(p.sums.PartMD5s) == 0 {
+		p.sums.PartMD5s = append(p.sums.PartMD5s, hex.EncodeToString(p.part.Sum(nil)))
+	}
+	p.sums.SHA256 = hex.EncodeToString(p.whole.Sum(nil))
+	return p.sums
+}
+
+// streamUpload uploads r, whose metadata is already known, with the shared
+// uploader. With full checksums each part is sent with its Content-MD5 and
+// r is hashed as it is read: the ETag of the object is checked against the
+// data sent once the upload is complete, and the SHA-256 of the stream is
+// the one of the result unless the caller set it.
+func (t *transfer) streamUpload(bucket string, r io.Reader, dst string, metadata map[string]*string) (*Result, error) {
+	partSize := t.partBytes()
+	var hasher *partHasher
+	if t.checked() {
+		hasher = newPartHasher(partSize)
+		r = io.TeeReader(r, hasher)
+	}
+	var size int64
+	result, err := t.uploader.UploadWithContext(aws.BackgroundContext(), &s3manager.UploadInput{
+		Body:         countingReader{r, func(n int64) { size += n }},
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(dst),
+		StorageClass: t.storageClass(),
+		Metadata:     t.metadata(metadata),
+	}, t.uploaderOptions)
+	if err != nil {
+		return t.result, errors.WithStack(err)
+	}
+	t.result.Location = result.Location
+	t.result.ETag = t.objectETag()
+	if hasher != nil {
+		sums := hasher.finish()
+		etag := sums.ETag()
+		if hasher.total >= partSize {
+			etag = sums.multipartETag()
+		}
+		if !SameETag(etag, t.result.ETag) {
+			return t.result, &ChecksumError{Key: dst, Local: etag, Remote: t.result.ETag}
+		}
+		if t.result.SHA256 == "" {
+			t.result.SHA256 = sums.SHA256
+		}
+	}
+	return t.done(size), nil
+}
@@ -0,0 +1,95 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPartHasher(t *testing.T) {
+	data := randomBytes(3000)
+	tests := []struct {
+		name string
+		size int
+		// writes are the lengths of the writes of data
+		writes []int
+	}{
+		{"one write", 3000, []int{3000}},
+		{"empty", 0, nil},
+		{"writes across parts", 3000, []int{100, 1500, 1, 1399}},
+		{"parts filled exactly", 2048, []int{1024, 1024}},
+		{"last part short", 2500, []int{2500}},
+	}
+	for _, tt := range tests {
+		src := writeFile(t, t.TempDir(), "src", data[:tt.size])
+		want, err := SumFile(src, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasher := newPartHasher(1024)
+		off := 0
+		for _, n := range tt.writes {
+			hasher.Write(data[off : off+n])
+			off += n
+		}
+		if got := hasher.finish(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: sums %+v, want %+v", tt.name, got, want)
+		}
+		if hasher.total != int64(tt.size) {
+			t.Errorf("%s: %d bytes hashed, want %d", tt.name, hasher.total, tt.size)
+		}
+	}
+}
+
+func TestUploadStream(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		// tamper is the part the device stores wrong, -1 for none
+		tamper int64
+	}{
+		{"single request", 100, -1},
+		{"one part", 5 * mb, -1},
+		{"parts", 10*mb + 100, -1},
+		{"single request stored wrong", 100, 0},
+		{"part stored wrong", 10*mb + 100, 2},
+	}
+	// the uploader takes no parts under 5 MB
+	opts := Options{PartSize: 5, Concurrency: 2}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, srv := testEngine(t)
+			data := randomBytes(tt.size)
+			srv.Tamper = func(key string, part int64, data []byte) []byte {
+				if part == tt.tamper {
+					data[0] ^= 1
+				}
+				return data
+			}
+			result, err := e.UploadStream(testBucket, bytes.NewReader(data), "dst", opts)
+			if tt.tamper >= 0 {
+				// the failure of a part comes wrapped by the uploader
+				if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+					t.Fatalf("upload stored wrong gave %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj := srv.Object(testBucket, "dst")
+			if obj == nil || !bytes.Equal(obj.Data, data) {
+				t.Fatal("object differs from the stream")
+			}
+			if !SameETag(obj.ETag, result.ETag) {
+				t.Errorf("ETag of the result %s, of the object %s", result.ETag, obj.ETag)
+			}
+			if sum := sha256.Sum256(data); result.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("SHA-256 of the result %s", result.SHA256)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// File types selected by --type.
+const (
+	typeFile    = "file"
+	typeSymlink = "symlink"
+	typeSpecial = "special"
+)
+
+var typeNames = map[string]string{
+	typeFile:    "regular file",
+	typeSymlink: "symlink",
+	typeSpecial: "special file",
+}
+
+// attrFilter selects files by their type, modification time and size. A
+// symlink is judged by the file it points to, which is what is uploaded,
+// unless links is set and the link itself is. Zero fields select every
+// file.
+type attrFilter struct {
+	types     map[string]bool
+	links     bool
+	newerThan time.Time
+	olderThan time.Time
+	minAge    time.Duration
+	minSize   int64
+	maxSize   int64
+	now       time.Time
+}
+
+// parseTime reads a --newer-than or --older-than value: a duration before
+// now, which may count days as 7d, or a date or RFC 3339 timestamp.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a duration like 36h or 7d, a date or an RFC 3339 timestamp", s)
+}
+
+func parseSize(name, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := cloud.ParseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return n, nil
+}
+
+// newAttrFilter returns the filter set by the flags of c.
+func newAttrFilter(c *cli.Context) (*attrFilter, error) {
+	f := &attrFilter{types: make(map[string]bool), links: c.Bool("symlinks"), minAge: c.Duration("min-age"),
+		now: time.Now()}
+	for _, t := range c.StringSlice("type") {
+		for _, t := range strings.Split(t, ",") {
+			switch t {
+			case typeFile, typeSymlink, typeSpecial:
+				f.types[t] = true
+			default:
+				return nil, fmt.Errorf("unknown type %q, expected %s, %s or %s", t, typeFile, typeSymlink, typeSpecial)
+			}
+		}
+	}
+	if len(f.types) == 0 {
+		f.types[typeFile] = true
+		f.types[typeSymlink] = true
+	}
+	var err error
+	if s := c.String("newer-than"); s != "" {
+		if f.newerThan, err = parseTime(s, f.now); err != nil {
+			return nil, err
+		}
+	}
+	if s := c.String("older-than"); s != "" {
+		if f.olderThan, err = parseTime(s, f.now); err != nil {
+			return nil, err
+		}
+	}
+	if f.minSize, err = parseSize("min-size", c.String("min-size")); err != nil {
+		return nil, err
+	}
+	if f.maxSize, err = parseSize("max-size", c.String("max-size")); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// fileType returns the --type of the file described by fi.
+func fileType(fi os.FileInfo) string {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return typeSymlink
+	case fi.Mode().IsRegular():
+		return typeFile
+	}
+	return typeSpecial
+}
+
+// match reports whether the file at path, described by fi from Lstat, is
+// selected, or else why not.
+func (f *attrFilter) match(path string, fi os.FileInfo) (bool, string) {
+	typ := fileType(fi)
+	if !f.types[typ] {
+		return false, fmt.Sprintf("a %s, not selected by --type", typeNames[typ])
+	}
+	if typ == typeSymlink && !f.links {
+		target, err := os.Stat(path)
+		if err != nil {
+			return false, fmt.Sprintf("a broken symlink, %v", err)
+		}
+		if target.IsDir() {
+			return false, "a symlink to a directory, not followed"
+		}
+		if !target.Mode().IsRegular() && !f.types[typeSpecial] {
+			return false, "a symlink to a special file, not selected by --type"
+		}
+		fi = target
+	}
+	mtime := fi.ModTime()
+	switch {
+	case !f.newerThan.IsZero() && !mtime.After(f.newerThan):
+		return false, fmt.Sprintf("modified %s, not after --newer-than %s", mtime.Format(time.RFC3339),
+			f.newerThan.Format(time.RFC3339))
+	case !f.olderThan.IsZero() && !mtime.Before(f.olderThan):
+		return false, fmt.Sprintf("modified %s, not before --older-than %s", mtime.Format(time.RFC3339),
+			f.olderThan.Format(time.RFC3339))
+	case f.minAge > 0 && f.now.Sub(mtime) < f.minAge:
+		return false, fmt.Sprintf("modified %s ago, less than --min-age %s", f.now.Sub(mtime).Round(time.Second),
+			f.minAge)
+	case fi.Size() < f.minSize:
+		return false, fmt.Sprintf("%d bytes, under --min-size", fi.Size())
+	case f.maxSize > 0 && fi.Size() > f.maxSize:
+		return false, fmt.Sprintf("%d bytes, over --max-size", fi.Size())
+	}
+	return true, ""
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+		err  bool
+	}{
+		{"36h", now.Add(-36 * time.Hour), false},
+		{"90m", now.Add(-90 * time.Minute), false},
+		{"7d", time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC), false},
+		{"0d", now, false},
+		{"2024-01-02T03:04:05Z", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"2024-01-02", time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), false},
+		{"xd", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"2024-13-01", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.in, now)
+		if (err != nil) != tt.err {
+			t.Errorf("parseTime(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTime(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAttrFilterMatch(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	file := func(name string, size int, mtime time.Time) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	link := func(name, target string) string {
+		path := filepath.Join(dir, name)
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	small := file("small", 10, old)
+	big := file("big", 5000, old)
+	fresh := file("fresh", 10, now)
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	toSmall := link("to-small", small)
+	toDir := link("to-dir", sub)
+	broken := link("broken", filepath.Join(dir, "missing"))
+
+	defaults := map[string]bool{typeFile: true, typeSymlink: true}
+	tests := []struct {
+		name   string
+		filter attrFilter
+		path   string
+		want   bool
+		reason string
+	}{
+		{"file", attrFilter{types: defaults}, small, true, ""},
+		{"file not selected", attrFilter{types: map[string]bool{typeSymlink: true}}, small, false, "regular file"},
+		{"symlink to file", attrFilter{types: defaults}, toSmall, true, ""},
+		{"symlink to directory", attrFilter{types: defaults}, toDir, false, "symlink to a directory"},
+		{"symlink not selected", attrFilter{types: map[string]bool{typeFile: true}}, toSmall, false, "a symlink, not"},
+		{"broken symlink", attrFilter{types: defaults}, broken, false, "broken symlink"},
+		{"broken symlink kept as link", attrFilter{types: defaults, links: true}, broken, true, ""},
+		{"symlink judged by target", attrFilter{types: defaults, minSize: 100}, toSmall, false, "under --min-size"},
+		{"newer than", attrFilter{types: defaults, newerThan: now.Add(-time.Hour)}, small, false, "--newer-than"},
+		{"newer than kept", attrFilter{types: defaults, newerThan: now.Add(-time.Hour)}, fresh, true, ""},
+		{"older than", attrFilter{types: defaults, olderThan: now.Add(-time.Hour)}, fresh, false, "--older-than"},
+		{"older than kept", attrFilter{types: defaults, olderThan: now.Add(-time.Hour)}, small, true, ""},
+		{"min age", attrFilter{types: defaults, minAge: time.Hour, now: now}, fresh, false, "--min-age"},
+		{"min age kept", attrFilter{types: defaults, minAge: time.Hour, now: now}, small, true, ""},
+		{"min size", attrFilter{types: defaults, minSize: 100}, small, false, "under --min-size"},
+		{"max size", attrFilter{types: defaults, maxSize: 100}, big, false, "over --max-size"},
+		{"size in range", attrFilter{types: defaults, minSize: 100, maxSize: 5000}, big, true, ""},
+	}
+	for _, tt := range tests {
+		fi, err := os.Lstat(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, reason := tt.filter.match(tt.path, fi)
+		if got != tt.want || !strings.Contains(reason, tt.reason) {
+			t.Errorf("%s: match = %v %q, want %v %q", tt.name, got, reason, tt.want, tt.reason)
+		}
+	}
+}
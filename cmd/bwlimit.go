@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// bwlimitFile, in the state directory, overrides the bwlimit flag and the
+// schedule while it exists. It is read again every bwlimitPoll and on
+// SIGHUP, when the schedule is checked too.
+const (
+	bwlimitFile = "bwlimit"
+	bwlimitPoll = 2 * time.Second
+)
+
+// limitBandwidth sets the shared bandwidth limit from the bwlimit flag, the
+// schedule and the control file, and follows them for the rest of the run.
+func limitBandwidth(c *cli.Context) error {
+	rate, err := cloud.ParseRate(c.GlobalString("bwlimit"))
+	if err != nil {
+		return err
+	}
+	schedule, err := cloud.ParseSchedule(c.GlobalStringSlice("schedule"))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(c.GlobalString("state_dir"), bwlimitFile)
+	applyLimit(path, rate, schedule)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		ticker := time.NewTicker(bwlimitPoll)
+		for {
+			select {
+			case <-ticker.C:
+			case <-hup:
+			}
+			applyLimit(path, rate, schedule)
+		}
+	}()
+	return nil
+}
+
+// applyLimit applies the limit of the control file at path, else the one
+// of the current schedule window, else the default rate.
+func applyLimit(path string, def int64, schedule cloud.Schedule) {
+	rate, paused := def, false
+	if w, ok := schedule.At(time.Now()); ok {
+		rate, paused = w.Rate, w.Paused
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if rate, paused, err = cloud.ParseLimit(string(data)); err != nil {
+			log.Println(err)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		log.Println(err)
+		return
+	}
+	if paused != cloud.Bandwidth.Paused() {
+		if paused {
+			log.Println("transfers paused, finishing the requests in flight")
+		} else {
+			log.Println("transfers resumed")
+		}
+		cloud.Bandwidth.SetPaused(paused)
+	}
+	if rate != cloud.Bandwidth.Rate() {
+		log.Printf("bandwidth limit set to %s\n", cloud.FormatRate(rate))
+		cloud.Bandwidth.SetRate(rate)
+	}
+}
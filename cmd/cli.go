@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"gopkg.in/urfave/cli.v1"
 	"gopkg.in/urfave/cli.v1/altsrc"
@@ -16,7 +17,7 @@ func App() *cli.App {
 	app.Description = "AWS snowball manager"
 	app.EnableBashCompletion = true
 	app.BashComplete = func(c *cli.Context) {
-		fmt.Fprintf(c.App.Writer, "list\nupload\ndelete\n")
+		fmt.Fprintf(c.App.Writer, "list\nupload\nget\ndelete\nsync\nrestore\ndiff\nmultipart\n")
 	}
 	app.Authors = []cli.Author{
 		{
@@ -48,6 +49,23 @@ func flags() []cli.Flag {
 		altsrc.NewStringFlag(cli.StringFlag{
 			Name: "aws_region",
 		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "state_dir",
+			Usage: "directory keeping the state of interrupted uploads",
+			Value: ".snowball",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "bwlimit",
+			Usage: "bandwidth limit shared by all transfers, e.g. 200MB/s with K, M or G units of 1024, changed at runtime by writing <state_dir>/bwlimit and sending SIGHUP",
+		}),
+		altsrc.NewStringSliceFlag(cli.StringSliceFlag{
+			Name:  "schedule",
+			Usage: "daily windows \"HH:MM-HH:MM limit\" with a bwlimit rate or paused as limit, the first matching wins",
+		}),
+		altsrc.NewStringFlag(cli.StringFlag{
+			Name:  "master_key_file",
+			Usage: "file holding the 256 bits master key of encrypted objects, else $" + masterKeyEnv,
+		}),
 		cli.StringFlag{
 			Name:  "cfg",
 			Value: "snowball.conf",
@@ -57,6 +75,8 @@ func flags() []cli.Flag {
 }
 
 func commands() []cli.Command {
+	syncRules := &filterRules{}
+	diffRules := &filterRules{}
 	cmds := []cli.Command{
 		{
 			Name:  "list",
@@ -75,6 +95,10 @@ func commands() []cli.Command {
 					Name:  "group, g",
 					Usage: "group objects by name",
 				},
+				cli.BoolFlag{
+					Name:  "original, o",
+					Usage: "also show the size of compressed objects before compression",
+				},
 				cli.BoolFlag{
 					Name:  "verbose, v",
 					Usage: "debug enabled",
@@ -119,7 +143,7 @@ func commands() []cli.Command {
 
 				cli.StringFlag{
 					Name:  "src, s",
-					Usage: "source file to upload",
+					Usage: "source file to upload, - for stdin",
 				},
 				cli.StringFlag{
 					Name:  "dst, d",
@@ -135,6 +159,39 @@ func commands() []cli.Command {
 					Usage: "number of threads to upload",
 					Value: 3,
 				},
+				cli.StringFlag{
+					Name:  "compress, z",
+					Usage: "compress with gzip or zstd while uploading, skipping compressed files",
+				},
+				cli.BoolFlag{
+					Name:  "encrypt, e",
+					Usage: "encrypt with AES-256-GCM under a new data key wrapped by the master key",
+				},
+				cli.StringFlag{
+					Name:  "storage-class",
+					Usage: "storage class of the uploaded objects, the bucket default when empty",
+				},
+				cli.StringSliceFlag{
+					Name:  "metadata",
+					Usage: "key=value stored with the uploaded objects, repeatable",
+				},
+				cli.StringFlag{
+					Name:  "checksum",
+					Usage: "full to send and check the MD5 and SHA-256 of the data, none to trust the transport",
+					Value: "full",
+				},
+				cli.BoolFlag{
+					Name:  "preserve",
+					Usage: "keep the mtime, mode, uid and gid of the files, and the empty directories, with the objects",
+				},
+				cli.BoolFlag{
+					Name:  "xattrs",
+					Usage: "with preserve, also keep the extended attributes of the files",
+				},
+				cli.BoolFlag{
+					Name:  "symlinks",
+					Usage: "with preserve, keep symlinks as links rather than uploading the files they point to",
+				},
 				cli.BoolFlag{
 					Name:  "verbose, v",
 					Usage: "debug enabled",
@@ -142,6 +199,49 @@ func commands() []cli.Command {
 			},
 			Action: commandUploadObjects,
 		},
+		{
+			Name:  "get",
+			Usage: "download an object",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bucket, b",
+					Usage: "source bucket",
+					Value: "test-cbbackup",
+				},
+				cli.StringFlag{
+					Name:  "key, k",
+					Usage: "object to download",
+				},
+				cli.StringFlag{
+					Name:  "dst, d",
+					Usage: "destination file, - for stdout, defaults to the key base name",
+				},
+				cli.Int64Flag{
+					Name:  "part, p",
+					Usage: "chunk part size in MB",
+					Value: 32,
+				},
+				cli.IntFlag{
+					Name:  "threads, t",
+					Usage: "number of threads to download chunks in parallel",
+					Value: 3,
+				},
+				cli.StringFlag{
+					Name:  "checksum",
+					Usage: "full to check the SHA-256 stored with the objects, none to trust the transport",
+					Value: "full",
+				},
+				cli.BoolFlag{
+					Name:  "preserve",
+					Usage: "reapply the mtime, mode, owner, extended attributes and symlinks kept with the objects, and restore the empty directories",
+				},
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "debug enabled",
+				},
+			},
+			Action: commandGetObject,
+		},
 		{
 			Name:  "sync",
 			Usage: "sync source directory to snowball",
@@ -160,11 +260,70 @@ func commands() []cli.Command {
 					Usage: "regex to filter",
 					Value: "",
 				},
+				cli.GenericFlag{
+					Name:  "include",
+					Usage: "glob, or re:<regex>, of the paths to sync, repeatable, the first matching --include or --exclude wins",
+					Value: &ruleFlag{list: syncRules, include: true},
+				},
+				cli.GenericFlag{
+					Name:  "exclude",
+					Usage: "glob, or re:<regex>, of the paths not to sync, excluded directories are not walked, repeatable",
+					Value: &ruleFlag{list: syncRules},
+				},
+				cli.StringFlag{
+					Name:  "ignore-file",
+					Usage: "per-directory file of exclude rules, ! to include, the last matching line winning, empty to disable",
+					Value: ".snowballignore",
+				},
+				cli.StringFlag{
+					Name:  "newer-than",
+					Usage: "only sync files modified after this duration ago, like 36h or 7d, date or RFC 3339 timestamp",
+				},
+				cli.StringFlag{
+					Name:  "older-than",
+					Usage: "only sync files modified before this duration ago, like 36h or 7d, date or RFC 3339 timestamp",
+				},
+				cli.DurationFlag{
+					Name:  "min-age",
+					Usage: "skip files modified less than this long ago, still being written",
+				},
+				cli.StringFlag{
+					Name:  "min-size",
+					Usage: "skip files smaller than this size in bytes, or with a K, M or G unit of 1024, like 10KB",
+				},
+				cli.StringFlag{
+					Name:  "max-size",
+					Usage: "skip files larger than this size in bytes, or with a K, M or G unit of 1024, like 4GB",
+				},
+				cli.StringSliceFlag{
+					Name:  "type",
+					Usage: "file, symlink or special, repeatable or comma separated (default: file,symlink)",
+				},
+				cli.StringSliceFlag{
+					Name:  "explain",
+					Usage: "tell why these paths are synced or not, then exit",
+				},
 				cli.StringFlag{
 					Name:  "prefix, x",
 					Usage: "s3 object path starts with this prefix",
 					Value: "",
 				},
+				cli.StringFlag{
+					Name:  "strip-root",
+					Usage: "local directory removed from the paths to make the keys",
+				},
+				cli.StringFlag{
+					Name:  "dst-prefix",
+					Usage: "prefix added to every key",
+				},
+				cli.StringSliceFlag{
+					Name:  "rewrite",
+					Usage: "regex=>replacement applied to the keys in order, repeatable",
+				},
+				cli.StringFlag{
+					Name:  "key-template",
+					Usage: "template of the keys, with {{.RelPath}}, {{.Dir}}, {{.Base}}, {{.Ext}}, {{.Path}}, {{.Date}} and {{.Host}}",
+				},
 				cli.Int64Flag{
 					Name:  "part, p",
 					Usage: "chunk part size in MB",
@@ -180,6 +339,108 @@ func commands() []cli.Command {
 					Usage: "number of files to be processed in parallel",
 					Value: 32,
 				},
+				cli.BoolFlag{
+					Name:  "detail",
+					Usage: "show a progress line per worker with the file it transfers",
+				},
+				cli.IntFlag{
+					Name:  "retries",
+					Usage: "attempts per file on network, throttling, server and checksum errors",
+					Value: 3,
+				},
+				cli.DurationFlag{
+					Name:  "retry-backoff",
+					Usage: "longest wait before the second attempt, doubled for each next one up to a minute",
+					Value: time.Second,
+				},
+				cli.DurationFlag{
+					Name:  "grace",
+					Usage: "on SIGINT or SIGTERM, time given to the transfers in flight to finish before they are cancelled",
+					Value: 30 * time.Second,
+				},
+				cli.StringFlag{
+					Name:  "compress, z",
+					Usage: "compress with gzip or zstd while uploading, skipping compressed files",
+				},
+				cli.BoolFlag{
+					Name:  "encrypt, e",
+					Usage: "encrypt with AES-256-GCM under a new data key wrapped by the master key",
+				},
+				cli.StringFlag{
+					Name:  "storage-class",
+					Usage: "storage class of the uploaded objects, the bucket default when empty",
+				},
+				cli.StringSliceFlag{
+					Name:  "metadata",
+					Usage: "key=value stored with the uploaded objects, repeatable",
+				},
+				cli.StringFlag{
+					Name:  "checksum",
+					Usage: "full to send and check the MD5 and SHA-256 of the data, none to trust the transport",
+					Value: "full",
+				},
+				cli.BoolFlag{
+					Name:  "preserve",
+					Usage: "keep the mtime, mode, uid and gid of the files, and the empty directories, with the objects",
+				},
+				cli.BoolFlag{
+					Name:  "xattrs",
+					Usage: "with preserve, also keep the extended attributes of the files",
+				},
+				cli.BoolFlag{
+					Name:  "symlinks",
+					Usage: "with preserve, keep symlinks as links rather than uploading the files they point to",
+				},
+				cli.StringFlag{
+					Name:  "compare, c",
+					Usage: "skip files already on the device, compared by size-mtime or checksum",
+					Value: "",
+				},
+				cli.Int64Flag{
+					Name:  "batch-under",
+					Usage: "pack files smaller than this size in KB of 1024 bytes into auto-extracting tar batches, 0 disables",
+					Value: 0,
+				},
+				cli.Int64Flag{
+					Name:  "batch-size",
+					Usage: "maximum size of a tar batch in MB",
+					Value: 100,
+				},
+				cli.IntFlag{
+					Name:  "batch-count",
+					Usage: "maximum number of files in a tar batch",
+					Value: 10000,
+				},
+				cli.BoolFlag{
+					Name:  "delete",
+					Usage: "delete the objects under the destination prefix with no local file",
+				},
+				cli.IntFlag{
+					Name:  "delete-max",
+					Usage: "refuse to delete more than this many objects, 0 for no limit",
+					Value: 1000,
+				},
+				cli.Float64Flag{
+					Name:  "delete-max-percent",
+					Usage: "refuse to delete more than this percentage of the objects under the prefix, 0 for no limit",
+					Value: 10,
+				},
+				cli.DurationFlag{
+					Name:  "abort-stale",
+					Usage: "first abort the multipart uploads under the destination prefix started longer ago than this, but those state_dir resumes, 0 disables",
+				},
+				cli.StringFlag{
+					Name:  "resume, r",
+					Usage: "resume the unfinished files of a previous run",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "write the JSON summary of the run to this file",
+				},
+				cli.BoolFlag{
+					Name:  "retry-failed",
+					Usage: "only retry the failed files of the resumed run, the latest one by default",
+				},
 				cli.BoolFlag{
 					Name:  "dry, d",
 					Usage: "dry-run, does not upload",
@@ -191,6 +452,314 @@ func commands() []cli.Command {
 			},
 			Action: commandSyncDirectory,
 		},
+		{
+			Name:  "restore",
+			Usage: "restore a bucket prefix into a local directory",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bucket, b",
+					Usage: "source bucket",
+					Value: "test-cbbackup",
+				},
+				cli.StringFlag{
+					Name:  "prefix, x",
+					Usage: "restore the objects under this prefix, removed from the local paths",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "dst, d",
+					Usage: "destination directory",
+				},
+				cli.StringFlag{
+					Name:  "compare, c",
+					Usage: "skip files already restored, compared by size-mtime or checksum",
+					Value: compareSizeMtime,
+				},
+				cli.Int64Flag{
+					Name:  "part, p",
+					Usage: "chunk part size in MB",
+					Value: 32,
+				},
+				cli.IntFlag{
+					Name:  "threads, t",
+					Usage: "number of threads to download chunks in parallel",
+					Value: 3,
+				},
+				cli.StringFlag{
+					Name:  "checksum",
+					Usage: "full to check the SHA-256 stored with the objects, none to trust the transport",
+					Value: "full",
+				},
+				cli.BoolFlag{
+					Name:  "preserve",
+					Usage: "reapply the mtime, mode, owner, extended attributes and symlinks kept with the objects, and restore the empty directories",
+				},
+				cli.IntFlag{
+					Name:  "forks, ff",
+					Usage: "number of files to be processed in parallel",
+					Value: 32,
+				},
+				cli.BoolFlag{
+					Name:  "detail",
+					Usage: "show a progress line per worker with the file it transfers",
+				},
+				cli.IntFlag{
+					Name:  "retries",
+					Usage: "attempts per file on network, throttling, server and checksum errors",
+					Value: 3,
+				},
+				cli.DurationFlag{
+					Name:  "retry-backoff",
+					Usage: "longest wait before the second attempt, doubled for each next one up to a minute",
+					Value: time.Second,
+				},
+				cli.DurationFlag{
+					Name:  "grace",
+					Usage: "on SIGINT or SIGTERM, time given to the transfers in flight to finish before they are cancelled",
+					Value: 30 * time.Second,
+				},
+				cli.StringFlag{
+					Name:  "report, r",
+					Usage: "JSON summary file, written next to the run journal when files failed by default",
+				},
+				cli.BoolFlag{
+					Name:  "dry",
+					Usage: "dry-run, does not download",
+				},
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "debug enabled",
+				},
+			},
+			Action: commandRestore,
+		},
+		{
+			Name:    "diff",
+			Aliases: []string{"verify"},
+			Usage:   "compare a source directory or prefix with a bucket prefix, exiting with 1 when they differ and 2 on failure",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bucket, b",
+					Usage: "source bucket",
+					Value: "test-cbbackup",
+				},
+				cli.StringFlag{
+					Name:  "src, s",
+					Usage: "source directory",
+				},
+				cli.StringFlag{
+					Name:  "filter, f",
+					Usage: "regex to filter",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "prefix, x",
+					Usage: "s3 object path starts with this prefix",
+					Value: "",
+				},
+				cli.GenericFlag{
+					Name:  "include",
+					Usage: "glob, or re:<regex>, of the paths compared, as given to sync",
+					Value: &ruleFlag{list: diffRules, include: true},
+				},
+				cli.GenericFlag{
+					Name:  "exclude",
+					Usage: "glob, or re:<regex>, of the paths not compared, as given to sync",
+					Value: &ruleFlag{list: diffRules},
+				},
+				cli.StringFlag{
+					Name:  "ignore-file",
+					Usage: "per-directory file of exclude rules, ! to include, the last matching line winning, empty to disable",
+					Value: ".snowballignore",
+				},
+				cli.StringFlag{
+					Name:  "strip-root",
+					Usage: "local directory removed from the paths to make the keys, as given to sync",
+				},
+				cli.StringFlag{
+					Name:  "dst-prefix",
+					Usage: "prefix added to every key, as given to sync",
+				},
+				cli.StringSliceFlag{
+					Name:  "rewrite",
+					Usage: "regex=>replacement applied to the keys in order, as given to sync",
+				},
+				cli.StringFlag{
+					Name:  "key-template",
+					Usage: "template of the keys, as given to sync",
+				},
+				cli.BoolFlag{
+					Name:  "preserve",
+					Usage: "also compare the empty directories, synced with preserve",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "compare this prefix of the bucket instead of a source directory",
+				},
+				cli.StringFlag{
+					Name:  "to-bucket",
+					Usage: "bucket compared with --from, defaults to --bucket",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "prefix compared with --from",
+				},
+				cli.BoolFlag{
+					Name:  "checksum, c",
+					Usage: "also compare checksums, reading local files",
+				},
+				cli.Int64Flag{
+					Name:  "part, p",
+					Usage: "chunk part size in MB used for the upload, to compare ETags",
+					Value: 32,
+				},
+				cli.BoolFlag{
+					Name:  "json, j",
+					Usage: "print the differences as JSON",
+				},
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "debug enabled",
+				},
+			},
+			Action: commandDiff,
+		},
+		{
+			Name:  "copy",
+			Usage: "copy the objects of a bucket prefix to another prefix or bucket, on the device",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bucket, b",
+					Usage: "source bucket",
+					Value: "test-cbbackup",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "prefix of the objects copied, all of them when empty",
+				},
+				cli.StringFlag{
+					Name:  "to-bucket",
+					Usage: "bucket copied to, defaults to --bucket",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "prefix replacing --from in the keys of the copies",
+				},
+				cli.Int64Flag{
+					Name:  "part, p",
+					Usage: "chunk part size in MB, objects as large are copied in parts",
+					Value: 32,
+				},
+				cli.IntFlag{
+					Name:  "threads, t",
+					Usage: "number of threads to copy parts in parallel",
+					Value: 3,
+				},
+				cli.IntFlag{
+					Name:  "forks, ff",
+					Usage: "number of objects to be copied in parallel",
+					Value: 32,
+				},
+				cli.StringFlag{
+					Name:  "storage-class",
+					Usage: "storage class of the copies, the bucket default when empty",
+				},
+				cli.BoolFlag{
+					Name:  "detail",
+					Usage: "show a progress line per worker with the object it copies",
+				},
+				cli.IntFlag{
+					Name:  "retries",
+					Usage: "attempts per object on network, throttling and server errors",
+					Value: 3,
+				},
+				cli.DurationFlag{
+					Name:  "retry-backoff",
+					Usage: "longest wait before the second attempt, doubled for each next one up to a minute",
+					Value: time.Second,
+				},
+				cli.DurationFlag{
+					Name:  "grace",
+					Usage: "on SIGINT or SIGTERM, time given to the copies in flight to finish before they are cancelled",
+					Value: 30 * time.Second,
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "write the JSON summary of the run to this file",
+				},
+				cli.BoolFlag{
+					Name:  "dry, d",
+					Usage: "dry-run, does not copy",
+				},
+				cli.BoolFlag{
+					Name:  "verbose, v",
+					Usage: "debug enabled",
+				},
+			},
+			Action: commandCopy,
+		},
+		{
+			Name:  "multipart",
+			Usage: "list or abort the unfinished multipart uploads",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list the unfinished multipart uploads with their parts",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "bucket, b",
+							Usage: "source bucket",
+							Value: "test-cbbackup",
+						},
+						cli.StringFlag{
+							Name:  "prefix, p",
+							Usage: "only the uploads of keys starting with this prefix",
+						},
+						cli.DurationFlag{
+							Name:  "older-than, o",
+							Usage: "only the uploads started longer ago than this, e.g. 24h",
+						},
+						cli.BoolFlag{
+							Name:  "verbose, v",
+							Usage: "debug enabled",
+						},
+					},
+					Action: commandMultipartList,
+				},
+				{
+					Name:  "abort",
+					Usage: "abort unfinished multipart uploads, freeing their parts",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "bucket, b",
+							Usage: "source bucket",
+							Value: "test-cbbackup",
+						},
+						cli.StringFlag{
+							Name:  "key, k",
+							Usage: "only the uploads of this key",
+						},
+						cli.StringFlag{
+							Name:  "prefix, p",
+							Usage: "only the uploads of keys starting with this prefix",
+						},
+						cli.DurationFlag{
+							Name:  "older-than, o",
+							Usage: "only the uploads started longer ago than this, e.g. 24h",
+						},
+						cli.BoolFlag{
+							Name:  "dry, d",
+							Usage: "dry-run, does not abort",
+						},
+						cli.BoolFlag{
+							Name:  "verbose, v",
+							Usage: "debug enabled",
+						},
+					},
+					Action: commandMultipartAbort,
+				},
+			},
+		},
 	}
 	return cmds
 }
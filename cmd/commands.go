@@ -4,11 +4,11 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -18,7 +18,6 @@ import (
 	"github.com/iandri/snowball/cloud"
 	"github.com/iandri/snowball/job"
 	"github.com/pkg/errors"
-	"gopkg.in/cheggaaa/pb.v1"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -40,6 +39,7 @@ func initialize(awsID, awsKey, awsEndpoint, awsRegion string, debug bool) error
 	if err != nil {
 		return err
 	}
+	engine = cloud.NewEngine(s3SVC)
 	return nil
 }
 
@@ -50,6 +50,7 @@ func svcNew(awsID, awsKey, awsEndpoint, awsRegion string, debug bool) (*s3.S3, e
 		return &s3.S3{}, errors.WithStack(err)
 	}
 
+	httpClient := &http.Client{}
 	snowConfig := &aws.Config{
 		Credentials:             credsUp,
 		Endpoint:                aws.String(awsEndpoint),
@@ -58,12 +59,19 @@ func svcNew(awsID, awsKey, awsEndpoint, awsRegion string, debug bool) (*s3.S3, e
 		S3ForcePathStyle:        aws.Bool(true),
 		S3Disable100Continue:    aws.Bool(true),
 		DisableComputeChecksums: aws.Bool(true),
+		HTTPClient:              httpClient,
 	}
 
 	sessUp, err := session.NewSession(snowConfig)
 	if err != nil {
 		return &s3.S3{}, errors.WithStack(err)
 	}
+	// wrapped after the session is made, it sets a custom CA bundle on a plain transport only
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient.Transport = cloud.LimitTransport(transport)
 
 	if debug {
 		sessUp.Config.WithLogLevel(
@@ -73,6 +81,8 @@ func svcNew(awsID, awsKey, awsEndpoint, awsRegion string, debug bool) (*s3.S3, e
 				aws.LogDebug)
 	}
 	s3Svc := s3.New(sessUp, snowConfig)
+	s3Svc.Handlers.Build.PushFront(cloud.CancelRequest)
+	s3Svc.Handlers.Sign.PushFront(cloud.HoldRequest)
 	return s3Svc, nil
 }
 
@@ -128,7 +138,19 @@ func commandListObjects(c *cli.Context) error {
 	}
 	for _, v := range content {
 		tme := v.LastModified.Format(time.RFC3339)
-		fmt.Printf("Key: %15s, Modified: %s, Size: %d\n", *v.Key, tme, *v.Size)
+		if !c.Bool("original") {
+			fmt.Printf("Key: %15s, Modified: %s, Size: %d\n", *v.Key, tme, *v.Size)
+			continue
+		}
+		head, err := cloud.HeadObject(s3SVC, c.String("bucket"), *v.Key)
+		if err != nil {
+			return err
+		}
+		original := cloud.OriginalSize(head.Metadata)
+		if original < 0 {
+			original = *v.Size
+		}
+		fmt.Printf("Key: %15s, Modified: %s, Size: %d, Original: %d\n", *v.Key, tme, *v.Size, original)
 	}
 	return nil
 }
@@ -163,6 +185,20 @@ func commandUploadObjects(c *cli.Context) error {
 	if err := checkFlags(c); err != nil {
 		return err
 	}
+	if err := limitBandwidth(c); err != nil {
+		return err
+	}
+	if c.String("src") == "-" && c.String("dst") == "" {
+		return fmt.Errorf("dst is missing")
+	}
+	enc, err := encoding(c)
+	if err != nil {
+		return err
+	}
+	opts, err := transferOptions(c, enc)
+	if err != nil {
+		return err
+	}
 	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
 		c.GlobalString("aws_region"), c.Bool("verbose"))
 	var dst string
@@ -171,8 +207,12 @@ func commandUploadObjects(c *cli.Context) error {
 	} else {
 		dst = c.String("dst")
 	}
-	result, err := cloud.UploadObject(s3SVC, c.String("bucket"), c.Int64("part"), c.Int("threads"),
-		c.String("src"), dst)
+	var result *cloud.Result
+	if c.String("src") == "-" {
+		result, err = engine.UploadStream(c.String("bucket"), os.Stdin, dst, opts)
+	} else {
+		result, err = engine.Upload(c.String("bucket"), c.String("src"), dst, opts)
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -180,6 +220,46 @@ func commandUploadObjects(c *cli.Context) error {
 	return nil
 }
 
+func commandGetObject(c *cli.Context) error {
+	if c.NumFlags() == 0 {
+		cli.ShowSubcommandHelp(c)
+		os.Exit(1)
+	}
+	if err := checkFlags(c); err != nil {
+		return err
+	}
+	if err := limitBandwidth(c); err != nil {
+		return err
+	}
+	if c.String("key") == "" {
+		return fmt.Errorf("key is missing")
+	}
+	masterKey, err := loadMasterKey(c)
+	if err != nil {
+		return err
+	}
+	opts, err := transferOptions(c, cloud.Encoding{Key: masterKey})
+	if err != nil {
+		return err
+	}
+	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
+		c.GlobalString("aws_region"), c.Bool("verbose"))
+	dst := c.String("dst")
+	if dst == "" {
+		dst = filepath.Base(c.String("key"))
+	}
+	result, err := engine.Download(c.String("bucket"), c.String("key"), dst, opts)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if dst == "-" {
+		fmt.Fprintln(os.Stderr, result)
+	} else {
+		fmt.Println(result)
+	}
+	return nil
+}
+
 func commandSyncDirectory(c *cli.Context) error {
 	if c.NumFlags() == 0 {
 		//cli.ShowCommandHelp(c, "delete")
@@ -189,38 +269,227 @@ func commandSyncDirectory(c *cli.Context) error {
 	if err := checkFlags(c); err != nil {
 		return err
 	}
-	fullPath, files, err := scanDir(c.String("src"), c.String("filter"), c.String("prefix"))
+	if err := limitBandwidth(c); err != nil {
+		return err
+	}
+	if err := checkCompare(c.String("compare")); err != nil {
+		return err
+	}
+	enc, err := encoding(c)
+	if err != nil {
+		return err
+	}
+	opts, err := transferOptions(c, enc)
+	if err != nil {
+		return err
+	}
+	if enc.Key != nil && c.Int64("batch-under") > 0 {
+		return fmt.Errorf("batch-under can't be used with encrypt, batches are extracted on the device")
+	}
+	if c.Bool("preserve") && c.Int64("batch-under") > 0 {
+		return fmt.Errorf("batch-under can't be used with preserve, the device drops the metadata of batched files")
+	}
+	mapper, err := newKeyMapper(c)
+	if err != nil {
+		return err
+	}
+	filter := newPathFilter(c.String("src"), c.Generic("include").(*ruleFlag).list.rules, c.String("ignore-file"))
+	attrs, err := newAttrFilter(c)
+	if err != nil {
+		return err
+	}
+	if len(c.StringSlice("explain")) > 0 {
+		return explainPaths(filter, attrs, c.String("filter"), c.StringSlice("explain"))
+	}
+	resume := c.String("resume") != "" || c.Bool("retry-failed")
+	if resume && c.Bool("delete") {
+		return fmt.Errorf("delete can't be used when resuming a run")
+	}
+	if resume && c.Duration("abort-stale") > 0 {
+		return fmt.Errorf("abort-stale can't be used when resuming a run")
+	}
+	var runID string
+	var fullPath, files []string
+	var leftOut *skippedPaths
+	if c.Bool("delete") {
+		leftOut = &skippedPaths{}
+	}
+	if resume {
+		runID, fullPath, files, err = resumeRun(c.GlobalString("state_dir"), c.String("resume"),
+			c.Bool("retry-failed"))
+	} else {
+		fullPath, files, err = scanDir(c.String("src"), c.String("filter"), c.String("prefix"), filter, attrs,
+			c.Bool("preserve"), leftOut)
+		if err == nil && mapper != nil {
+			files, err = mapper.mapKeys(fullPath, files)
+		}
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
+	syncPrefix := syncDestination(c, mapper, files)
+	if syncPrefix == "" && (c.Bool("delete") || c.Duration("abort-stale") > 0) {
+		return fmt.Errorf("delete and abort-stale need the keys under a prefix, not the whole bucket")
+	}
 
-	var wg sync.WaitGroup
-
-	if !c.Bool("dry") {
+	if !c.Bool("dry") || c.String("compare") != "" || c.Bool("delete") || c.Duration("abort-stale") > 0 {
 		initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
 			c.GlobalString("aws_region"), c.Bool("verbose"))
 	}
-	filesCount := len(files)
-	bar := pb.StartNew(filesCount)
-	bar.ShowTimeLeft = false
-	job.StartDispather(c.Int("forks"))
-	for i, file := range files {
-		if c.Bool("dry") {
-			wg.Add(1)
+	if c.Duration("abort-stale") > 0 {
+		uploads, err := matchingUploads(c.String("bucket"), uploadFilter{
+			prefix:    syncPrefix,
+			olderThan: c.Duration("abort-stale"),
+		})
+		if err == nil {
+			err = abortUploads(c.String("bucket"), c.GlobalString("state_dir"), uploads, c.Bool("dry"))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	var objects map[string]*s3.Object
+	var batched map[string]*job.BatchedFile
+	if c.String("compare") != "" {
+		if batched, err = job.BatchedFiles(c.GlobalString("state_dir")); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if c.String("compare") != "" || c.Bool("delete") {
+		prefix := keysPrefix(files)
+		if c.Bool("delete") || len(batched) > 0 {
+			// the batches are stored under the destination prefix
+			prefix = syncPrefix
+		}
+		if objects, err = remoteObjects(c.String("bucket"), prefix); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var deletions []string
+	if c.Bool("delete") {
+		deletions, err = plannedDeletions(objects, files, leftOut, mapper, syncPrefix, filter, c.String("filter"))
+		if err != nil {
+			return err
+		}
+		err := checkDeletions(len(deletions), len(objects), c.Int("delete-max"), c.Float64("delete-max-percent"))
+		if err != nil {
+			return err
+		}
+	}
+	scanned := len(files)
+	if c.String("compare") != "" {
+		masterKey, err := loadMasterKey(c)
+		if err != nil {
+			return err
+		}
+		fullPath, files, err = changedFiles(c.String("compare"), c.String("bucket"), objects, batched,
+			c.Int64("part"), fullPath, files, c.Bool("preserve") && c.Bool("symlinks"), masterKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("%d of %d files already on the device, skipping\n", scanned-len(files), scanned)
+	}
+	skipped := scanned - len(files)
+
+	var journal *job.Journal
+	if !c.Bool("dry") {
+		journal, err = syncJournal(c.GlobalString("state_dir"), job.RunSync, runID, fullPath, files)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("run %s, journal %s\n", journal.ID, journal.Path)
+	}
+	var batches []*job.Batch
+	if c.Int64("batch-under") > 0 {
+		name, first := "dry", 1
+		if journal != nil {
+			// a resumed run numbers its batches after the ones of its earlier attempts
+			name, first = journal.ID, journal.Batches()+1
+		}
+		fullPath, files, batches, err = job.MakeBatches(fullPath, files, c.Int64("batch-under")*1024,
+			c.Int64("batch-size")*1024*1024, c.Int("batch-count"), syncPrefix, name, first)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if c.Bool("dry") {
+		for _, batch := range batches {
+			fmt.Printf("batching %d files (%d bytes) to s3://%s/%s\n", len(batch.Files), batch.Size,
+				c.String("bucket"), batch.Key)
+			for i, file := range batch.Files {
+				fmt.Printf("  %s -> %s\n", batch.FullPath[i], file)
+			}
+		}
+		for i, file := range files {
 			fmt.Printf("uploading %s to s3://%s/%s\n", fullPath[i], c.String("bucket"), file)
-			wg.Done()
-		} else {
-			wg.Add(1)
-			job.Collector(bar, &wg, s3SVC, c.String("bucket"), c.Int64("part"), c.Int("threads"),
-				fullPath[i], file)
 		}
+		deleteObjects(nil, c.String("bucket"), deletions, true)
+		fmt.Println("Done!")
+		return nil
+	}
+
+	transfer := job.Transfer{Engine: engine, Bucket: c.String("bucket"), Options: opts}
+	var tasks []job.Task
+	total := localBytes(fullPath)
+	for _, batch := range batches {
+		for _, src := range batch.FullPath {
+			if err := journal.Batched(src, batch.Key); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		tasks = append(tasks, &job.BatchUpload{Transfer: transfer, Batch: batch})
+		total += batch.Size
+	}
+	for i, file := range files {
+		tasks = append(tasks, &job.Upload{Transfer: transfer, Src: fullPath[i], Dst: file})
+	}
+
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	handleSignals(interrupt, c.Duration("grace"))
+	bar := newProgress(total, len(tasks), c.Int("forks"), c.Bool("detail"))
+	pool := job.NewPool(ctx, c.Int("forks"))
+	pool.Retry = retryPolicy(c)
+	pool.Progress = bar
+	pool.Journal = journal
+	start := time.Now()
+	runTasks(pool, tasks)
+	deleted := &deleteResult{}
+	if len(deletions) > 0 && !pool.Interrupted() {
+		deletePool := job.NewPool(ctx, c.Int("forks"))
+		deletePool.Retry = pool.Retry
+		deleted.n, deleted.failures = deleteObjects(deletePool, c.String("bucket"), deletions, false)
+	}
+	summary, err := finishRun(bar, pool, "uploaded", skipped, start, c.String("report"), "", deleted)
+	if pool.Interrupted() {
+		fmt.Printf("resume the run with: sync --resume %s\n", journal.ID)
+	} else if summary.Failed > 0 {
+		fmt.Printf("retry the failed files with: sync --resume %s --retry-failed\n", journal.ID)
+	}
+	return err
+}
+
+// skippedPaths are the files and directories scanDir left out although
+// they are under its source, with the keys they would have had.
+type skippedPaths struct {
+	fullPath []string
+	files    []string
+}
+
+func (s *skippedPaths) add(path, key string) {
+	if s != nil {
+		s.fullPath = append(s.fullPath, path)
+		s.files = append(s.files, key)
 	}
-	wg.Wait()
-	bar.FinishPrint("Done!")
-	return nil
 }
 
-func scanDir(searchDir, regex, prefix string) ([]string, []string, error) {
+// scanDir lists the files under searchDir kept by filter and attrs, when
+// set, and matching regex, along with the empty directories when dirs is
+// set. Their keys are their paths, or the part of them from prefix on, with
+// a trailing slash for the directories. The files and directories left
+// out are added to skipped, when set.
+func scanDir(searchDir, regex, prefix string, filter *pathFilter, attrs *attrFilter, dirs bool,
+	skipped *skippedPaths) ([]string, []string, error) {
 	pathRe := &regexp.Regexp{}
 	filterRe := &regexp.Regexp{}
 
@@ -232,6 +501,19 @@ func scanDir(searchDir, regex, prefix string) ([]string, []string, error) {
 		re := fmt.Sprintf("%s/.*", prefix)
 		pathRe = regexp.MustCompile(re)
 	}
+	keyOf := func(path string, isDir bool) (string, bool) {
+		key := path
+		if prefix != "" {
+			if !pathRe.MatchString(path) {
+				return "", false
+			}
+			key = pathRe.FindString(path)
+		}
+		if isDir {
+			key += "/"
+		}
+		return key, true
+	}
 
 	fullFileList := make([]string, 0)
 	fileList := make([]string, 0)
@@ -239,29 +521,45 @@ func scanDir(searchDir, regex, prefix string) ([]string, []string, error) {
 		if err != nil {
 			return err
 		}
-		switch {
-		case regex != "":
-			if filterRe.MatchString(path) {
-				if !f.IsDir() {
-					fullFileList = append(fullFileList, path)
-					fileList = append(fileList, path)
-				}
+		if filter != nil && path != searchDir {
+			rel, err := filepath.Rel(searchDir, path)
+			if err != nil {
+				return err
+			}
+			include, _, err := filter.match(filepath.ToSlash(rel), f.IsDir())
+			if err != nil {
+				return err
 			}
-		case prefix != "":
-			if pathRe.MatchString(path) {
-				if !f.IsDir() {
-					fullFileList = append(fullFileList, path)
-					path = pathRe.FindString(path)
-					fileList = append(fileList, path)
+			if !include {
+				if key, ok := keyOf(path, f.IsDir()); ok {
+					skipped.add(path, key)
 				}
+				if f.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
 			}
-		default:
-			if !f.IsDir() {
-				fullFileList = append(fullFileList, path)
-				fileList = append(fileList, path)
+		}
+		if f.IsDir() && (!dirs || path == searchDir || !emptyDir(path)) {
+			return nil
+		}
+		key, ok := keyOf(path, f.IsDir())
+		if !ok {
+			return nil
+		}
+		if regex != "" && !filterRe.MatchString(path) {
+			skipped.add(path, key)
+			return nil
+		}
+		if !f.IsDir() && attrs != nil {
+			if ok, _ := attrs.match(path, f); !ok {
+				skipped.add(path, key)
+				return nil
 			}
 		}
-		return err
+		fullFileList = append(fullFileList, path)
+		fileList = append(fileList, key)
+		return nil
 	})
 	if e != nil {
 		return nil, nil, e
@@ -269,6 +567,17 @@ func scanDir(searchDir, regex, prefix string) ([]string, []string, error) {
 	return fullFileList, fileList, nil
 }
 
+// emptyDir reports whether the directory path has no entry.
+func emptyDir(path string) bool {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer dir.Close()
+	names, _ := dir.Readdirnames(1)
+	return len(names) == 0
+}
+
 type s3Obj []*s3.Object
 
 func (s s3Obj) Len() int {
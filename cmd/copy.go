@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// copyTasks lists the objects of bucket under from and returns the tasks
+// copying them with transfer, from replaced by to in their keys.
+func copyTasks(transfer job.Transfer, bucket, from, to string) ([]*job.Copy, error) {
+	var tasks []*job.Copy
+	err := cloud.WalkObjects(s3SVC, bucket, from, func(o *s3.Object) bool {
+		tasks = append(tasks, &job.Copy{Transfer: transfer, SrcBucket: bucket, SrcKey: *o.Key,
+			Dst: to + strings.TrimPrefix(*o.Key, from), Bytes: aws.Int64Value(o.Size)})
+		return true
+	})
+	return tasks, err
+}
+
+func commandCopy(c *cli.Context) error {
+	if c.NumFlags() == 0 {
+		cli.ShowSubcommandHelp(c)
+		os.Exit(1)
+	}
+	if err := checkFlags(c); err != nil {
+		return err
+	}
+	toBucket := c.String("to-bucket")
+	if toBucket == "" {
+		toBucket = c.String("bucket")
+	}
+	if toBucket == c.String("bucket") && c.String("from") == c.String("to") {
+		return fmt.Errorf("from and to are the same objects")
+	}
+	opts, err := transferOptions(c, cloud.Encoding{})
+	if err != nil {
+		return err
+	}
+	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
+		c.GlobalString("aws_region"), c.Bool("verbose"))
+
+	transfer := job.Transfer{Engine: engine, Bucket: toBucket, Options: opts}
+	copies, err := copyTasks(transfer, c.String("bucket"), c.String("from"), c.String("to"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("dry") {
+		for _, t := range copies {
+			fmt.Printf("copying s3://%s/%s to s3://%s/%s\n", t.SrcBucket, t.SrcKey, toBucket, t.Dst)
+		}
+		return nil
+	}
+
+	keys := make([]string, 0, len(copies))
+	dsts := make([]string, 0, len(copies))
+	tasks := make([]job.Task, 0, len(copies))
+	var total int64
+	for _, t := range copies {
+		keys = append(keys, t.SrcKey)
+		dsts = append(dsts, t.Dst)
+		tasks = append(tasks, t)
+		total += t.Bytes
+	}
+	journal, err := syncJournal(c.GlobalString("state_dir"), job.RunCopy, "", keys, dsts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("run %s, journal %s\n", journal.ID, journal.Path)
+
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	handleSignals(interrupt, c.Duration("grace"))
+	bar := newProgress(total, len(tasks), c.Int("forks"), c.Bool("detail"))
+	pool := job.NewPool(ctx, c.Int("forks"))
+	pool.Retry = retryPolicy(c)
+	pool.Progress = bar
+	pool.Journal = journal
+	start := time.Now()
+	runTasks(pool, tasks)
+	_, err = finishRun(bar, pool, "copied", 0, start, c.String("report"),
+		strings.TrimSuffix(journal.Path, ".jsonl")+"-report.json", nil)
+	if pool.Interrupted() {
+		fmt.Println("run copy again to copy the objects left")
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/cloud/s3test"
+	"github.com/iandri/snowball/job"
+)
+
+func TestCopyTasks(t *testing.T) {
+	srv := s3test.NewServer("src", "dst")
+	defer srv.Close()
+	saved := s3SVC
+	defer func() { s3SVC = saved }()
+	s3SVC = srv.Client()
+	objects := map[string][]byte{
+		"bk/a":              []byte("a"),
+		"bk/dir b/c+d%.txt": []byte("c"),
+		"bk/dir/":           nil,
+		"other/e":           []byte("e"),
+	}
+	for key, data := range objects {
+		srv.PutObject("src", key, data, nil)
+	}
+	transfer := job.Transfer{Engine: cloud.NewEngine(s3SVC), Bucket: "dst",
+		Options: cloud.Options{PartSize: 1, Concurrency: 1}}
+	copies, err := copyTasks(transfer, "src", "bk/", "copy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"bk/a": "copy/a", "bk/dir b/c+d%.txt": "copy/dir b/c+d%.txt", "bk/dir/": "copy/dir/"}
+	if len(copies) != len(want) {
+		t.Fatalf("%d copies, want %d", len(copies), len(want))
+	}
+	tasks := make([]job.Task, 0, len(copies))
+	for _, c := range copies {
+		if c.Dst != want[c.SrcKey] || c.Bytes != int64(len(objects[c.SrcKey])) {
+			t.Errorf("%s copied to %s, %d bytes, want %s, %d bytes", c.SrcKey, c.Dst, c.Bytes, want[c.SrcKey],
+				len(objects[c.SrcKey]))
+		}
+		tasks = append(tasks, c)
+	}
+	for _, res := range runTasks(job.NewPool(context.Background(), 2), tasks) {
+		if res.Err != nil {
+			t.Errorf("%s: %v", res.Task.Name(), res.Err)
+		}
+	}
+	for src, dst := range want {
+		if o := srv.Object("dst", dst); o == nil || !bytes.Equal(o.Data, objects[src]) {
+			t.Errorf("%s not copied to %s", src, dst)
+		}
+	}
+}
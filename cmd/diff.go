@@ -0,0 +1,376 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// diffObject is one side of a comparison: a local file when Path is set,
+// an object of Bucket otherwise. The object of a file held by the tar
+// batch Batch is the batch.
+type diffObject struct {
+	Name    string
+	Path    string
+	Bucket  string
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+	Batch   string
+}
+
+type diffEntry struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+type diffReport struct {
+	Source      string      `json:"source"`
+	Target      string      `json:"target"`
+	Matched     int         `json:"matched"`
+	Differences []diffEntry `json:"differences"`
+}
+
+// localObjects lists the files under src the way sync does, selected by
+// regex, filter and attrs, with the empty directories when dirs is set,
+// and names them by their keys, mapped by mapper when set.
+func localObjects(src, regex, prefix string, filter *pathFilter, attrs *attrFilter, mapper *keyMapper,
+	dirs bool) (map[string]*diffObject, []string, error) {
+	fullPath, files, err := scanDir(src, regex, prefix, filter, attrs, dirs, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mapper != nil {
+		if files, err = mapper.mapKeys(fullPath, files); err != nil {
+			return nil, nil, err
+		}
+	}
+	objects := make(map[string]*diffObject, len(files))
+	for i, file := range files {
+		fi, err := os.Stat(fullPath[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		o := &diffObject{Name: file, Path: fullPath[i], Size: fi.Size(), ModTime: fi.ModTime()}
+		if fi.IsDir() {
+			// the marker of an empty directory holds no data
+			o.Size = 0
+		}
+		objects[file] = o
+	}
+	return objects, files, nil
+}
+
+// bucketObjects lists bucket under prefix, naming every object by its key
+// with the prefix removed unless keep is set.
+func bucketObjects(bucket, prefix string, keep bool) (map[string]*diffObject, error) {
+	objects := make(map[string]*diffObject)
+	err := cloud.WalkObjects(s3SVC, bucket, prefix, func(o *s3.Object) bool {
+		name := *o.Key
+		if !keep {
+			name = strings.TrimPrefix(name, prefix)
+		}
+		objects[name] = &diffObject{
+			Name:    name,
+			Bucket:  bucket,
+			Key:     *o.Key,
+			Size:    aws.Int64Value(o.Size),
+			ModTime: aws.TimeValue(o.LastModified),
+			ETag:    strings.Trim(aws.StringValue(o.ETag), `"`),
+		}
+		return true
+	})
+	return objects, err
+}
+
+// addBatched adds to objects, listed by key, the files of batched held by
+// one of their batches, which are dropped.
+func addBatched(objects map[string]*diffObject, batched map[string]*job.BatchedFile) {
+	for key, b := range batched {
+		batch, ok := objects[b.Batch]
+		if _, exists := objects[key]; !ok || exists {
+			continue
+		}
+		objects[key] = &diffObject{Name: key, Bucket: batch.Bucket, Key: batch.Key, Size: b.Size, ModTime: b.Time,
+			Batch: b.Batch}
+	}
+	for name := range objects {
+		if job.IsBatchKey(name) {
+			delete(objects, name)
+		}
+	}
+}
+
+// checksum returns the SHA-256 of the object, from its metadata for remote
+// objects, or the HMAC of it an encrypted object records, mac then being
+// set. It is empty when it is not known.
+func (o *diffObject) checksum() (sum string, mac bool, err error) {
+	if o.Path != "" {
+		sum, err = cloud.FileSHA256(o.Path)
+		return sum, false, err
+	}
+	head, err := cloud.HeadObject(s3SVC, o.Bucket, o.Key)
+	if err != nil {
+		return "", false, err
+	}
+	if sum := cloud.Metadata(head.Metadata, cloud.SHA256MACKey); sum != "" {
+		return sum, true, nil
+	}
+	return cloud.Metadata(head.Metadata, cloud.SHA256Key), false, nil
+}
+
+// originalSize returns the size of the data of o before it was compressed
+// or encrypted, its stored size when it was not.
+func (o *diffObject) originalSize() (int64, error) {
+	if o.Path != "" {
+		return o.Size, nil
+	}
+	head, err := cloud.HeadObject(s3SVC, o.Bucket, o.Key)
+	if err != nil {
+		return 0, err
+	}
+	if size := cloud.OriginalSize(head.Metadata); size >= 0 {
+		return size, nil
+	}
+	return o.Size, nil
+}
+
+// sameContent compares the checksums of src and dst, the SHA-256 of one
+// with the HMAC of the other with masterKey, falling back on the ETag when
+// they can't be compared.
+func sameContent(src, dst *diffObject, partSize int64, masterKey []byte) (bool, string, string, error) {
+	dstSum, dstMAC, err := dst.checksum()
+	if err != nil {
+		return false, "", "", err
+	}
+	var srcSum string
+	var srcMAC bool
+	if dstSum != "" {
+		if srcSum, srcMAC, err = src.checksum(); err != nil {
+			return false, "", "", err
+		}
+	}
+	if srcSum != "" && srcMAC != dstMAC {
+		switch {
+		case masterKey == nil:
+			srcSum = ""
+		case srcMAC:
+			dstSum = cloud.SHA256MAC(masterKey, dstSum)
+		default:
+			srcSum = cloud.SHA256MAC(masterKey, srcSum)
+		}
+	}
+	if srcSum != "" && dstSum != "" {
+		return srcSum == dstSum, srcSum, dstSum, nil
+	}
+	srcETag := src.ETag
+	if src.Path != "" {
+		if srcETag, err = cloud.LocalETag(src.Path, partSize); err != nil {
+			return false, "", "", err
+		}
+	}
+	return srcETag == dst.ETag, srcETag, dst.ETag, nil
+}
+
+// diffObjects compares the objects of src and dst, by their checksums when
+// checksum is set, masterKey checking those of encrypted objects.
+func diffObjects(src, dst map[string]*diffObject, srcName, dstName string, checksum bool, partSize int64,
+	masterKey []byte) (*diffReport, error) {
+	report := &diffReport{Source: srcName, Target: dstName, Differences: []diffEntry{}}
+	names := make([]string, 0, len(src)+len(dst))
+	for name := range src {
+		names = append(names, name)
+	}
+	for name := range dst {
+		if _, ok := src[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s, inSrc := src[name]
+		d, inDst := dst[name]
+		if inSrc && inDst && s.Size != d.Size {
+			// the stored size of an encoded object is not the size of its data
+			var err error
+			if s.Size, err = s.originalSize(); err != nil {
+				return nil, err
+			}
+			if d.Size, err = d.originalSize(); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case !inDst:
+			report.Differences = append(report.Differences, diffEntry{Name: name, Kind: srcName + "-only"})
+		case !inSrc:
+			report.Differences = append(report.Differences, diffEntry{Name: name, Kind: dstName + "-only"})
+		case strings.HasSuffix(name, "/"):
+			// a directory marker only has to exist
+			report.Matched++
+		case s.Size != d.Size:
+			report.Differences = append(report.Differences, diffEntry{Name: name, Kind: "size",
+				Source: fmt.Sprint(s.Size), Target: fmt.Sprint(d.Size)})
+		// the device keeps the time of an object to the second
+		case s.Path != "" && s.ModTime.Truncate(time.Second).After(d.ModTime):
+			report.Differences = append(report.Differences, diffEntry{Name: name, Kind: "mtime",
+				Source: s.ModTime.Format(time.RFC3339), Target: d.ModTime.Format(time.RFC3339)})
+		case d.Batch != "":
+			// the data of a batched file is in its batch until import
+			report.Matched++
+		case checksum:
+			same, srcSum, dstSum, err := sameContent(s, d, partSize, masterKey)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				report.Differences = append(report.Differences, diffEntry{Name: name, Kind: "checksum",
+					Source: srcSum, Target: dstSum})
+				continue
+			}
+			report.Matched++
+		default:
+			report.Matched++
+		}
+	}
+	return report, nil
+}
+
+// write prints the report, as JSON when asJSON is set.
+func (r *diffReport) write(asJSON bool) error {
+	if !asJSON {
+		r.print()
+		return nil
+	}
+	out, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func (r *diffReport) print() {
+	for _, d := range r.Differences {
+		if d.Source == "" {
+			fmt.Printf("%-12s %s\n", d.Kind, d.Name)
+		} else {
+			fmt.Printf("%-12s %s: %s != %s\n", d.Kind, d.Name, d.Source, d.Target)
+		}
+	}
+	fmt.Printf("%d matched, %d differences between %s and %s\n", r.Matched, len(r.Differences),
+		r.Source, r.Target)
+}
+
+// Exit codes of diff, the ones of diff(1). No differences is 0.
+const (
+	exitDiffers    = 1
+	exitDiffFailed = 2
+)
+
+// diffExit returns the error carrying the exit code of a diff that gave
+// report or failed with err.
+func diffExit(report *diffReport, err error) error {
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitDiffFailed)
+	}
+	if len(report.Differences) > 0 {
+		return cli.NewExitError("", exitDiffers)
+	}
+	return nil
+}
+
+func commandDiff(c *cli.Context) error {
+	if c.NumFlags() == 0 {
+		cli.ShowSubcommandHelp(c)
+		os.Exit(exitDiffFailed)
+	}
+	report, err := diff(c)
+	return diffExit(report, err)
+}
+
+// diff compares the source and target of c and prints the report.
+func diff(c *cli.Context) (*diffReport, error) {
+	if err := checkFlags(c); err != nil {
+		return nil, err
+	}
+	if c.String("src") == "" && c.String("from") == "" {
+		return nil, fmt.Errorf("src or from is missing")
+	}
+	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
+		c.GlobalString("aws_region"), c.Bool("verbose"))
+
+	var src, dst map[string]*diffObject
+	var srcName, dstName string
+	var err error
+	if c.String("from") == "" {
+		// the files and keys are the ones sync would upload
+		var mapper *keyMapper
+		var attrs *attrFilter
+		if mapper, err = newKeyMapper(c); err != nil {
+			return nil, err
+		}
+		if attrs, err = newAttrFilter(c); err != nil {
+			return nil, err
+		}
+		filter := newPathFilter(c.String("src"), c.Generic("include").(*ruleFlag).list.rules, c.String("ignore-file"))
+		var files []string
+		src, files, err = localObjects(c.String("src"), c.String("filter"), c.String("prefix"), filter, attrs,
+			mapper, c.Bool("preserve"))
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			// with no keys to take the destination from, the whole bucket would be listed
+			report := &diffReport{Source: "local", Target: "remote", Differences: []diffEntry{}}
+			return report, report.write(c.Bool("json"))
+		}
+		dst, err = bucketObjects(c.String("bucket"), syncDestination(c, mapper, files), true)
+		if err != nil {
+			return nil, err
+		}
+		batched, err := job.BatchedFiles(c.GlobalString("state_dir"))
+		if err != nil {
+			return nil, err
+		}
+		addBatched(dst, batched)
+		srcName, dstName = "local", "remote"
+	} else {
+		toBucket := c.String("to-bucket")
+		if toBucket == "" {
+			toBucket = c.String("bucket")
+		}
+		src, err = bucketObjects(c.String("bucket"), c.String("from"), false)
+		if err != nil {
+			return nil, err
+		}
+		dst, err = bucketObjects(toBucket, c.String("to"), false)
+		srcName, dstName = "source", "target"
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := loadMasterKey(c)
+	if err != nil {
+		return nil, err
+	}
+	report, err := diffObjects(src, dst, srcName, dstName, c.Bool("checksum"), c.Int64("part"), masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return report, report.write(c.Bool("json"))
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestDiffBatched(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "aaaa", "b": "bbbb"})
+	now := time.Now()
+	batch := "bk/" + job.BatchKeyPrefix + "run-00001.tar"
+	dst := map[string]*diffObject{
+		batch:  {Name: batch, Bucket: "bucket", Key: batch, Size: 3072},
+		"bk/c": {Name: "bk/c", Bucket: "bucket", Key: "bk/c", Size: 1, ModTime: now},
+	}
+	addBatched(dst, map[string]*job.BatchedFile{
+		"bk/a": {Key: "bk/a", Batch: batch, Size: 4, Time: now.Add(time.Minute)},
+		"bk/b": {Key: "bk/b", Batch: batch, Size: 4, Time: now.Add(-time.Hour)},
+		// the object of its own wins
+		"bk/c": {Key: "bk/c", Batch: batch, Size: 4, Time: now},
+		"bk/d": {Key: "bk/d", Batch: "bk/" + job.BatchKeyPrefix + "gone-00001.tar", Size: 4, Time: now},
+	})
+	if _, ok := dst[batch]; ok {
+		t.Error("batch left in the objects compared")
+	}
+	if _, ok := dst["bk/d"]; ok {
+		t.Error("file of a batch not on the device added")
+	}
+	if c := dst["bk/c"]; c.Batch != "" || c.Size != 1 {
+		t.Errorf("object of bk/c replaced by %+v", c)
+	}
+
+	src, _, err := localObjects(dir, "", "", nil, nil, testMapper(dir, "bk", nil, ""), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := diffObjects(src, dst, "local", "remote", true, 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"bk/b": "mtime", "bk/c": "remote-only"}
+	if report.Matched != 1 || len(report.Differences) != len(want) {
+		t.Fatalf("report %+v", report)
+	}
+	for _, d := range report.Differences {
+		if want[d.Name] != d.Kind {
+			t.Errorf("%s differs by %s, want %s", d.Name, d.Kind, want[d.Name])
+		}
+	}
+}
+
+func TestDiffExit(t *testing.T) {
+	same := &diffReport{Matched: 1, Differences: []diffEntry{}}
+	differs := &diffReport{Differences: []diffEntry{{Name: "a", Kind: "size"}}}
+	tests := []struct {
+		name   string
+		report *diffReport
+		err    error
+		want   int
+	}{
+		{"same", same, nil, 0},
+		{"differences", differs, nil, exitDiffers},
+		{"failure", nil, errors.New("no such bucket"), exitDiffFailed},
+	}
+	for _, tt := range tests {
+		code := 0
+		if err := diffExit(tt.report, tt.err); err != nil {
+			code = err.(cli.ExitCoder).ExitCode()
+		}
+		if code != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iandri/snowball/cloud"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// masterKeyEnv holds the master key itself, hex or base64 encoded, when no
+// key file is given.
+const masterKeyEnv = "SNOWBALL_MASTER_KEY"
+
+// loadMasterKey returns the master key from the master_key_file flag or
+// the masterKeyEnv variable, or nil when neither is set.
+func loadMasterKey(c *cli.Context) ([]byte, error) {
+	if path := c.GlobalString("master_key_file"); path != "" {
+		return cloud.LoadMasterKey(path)
+	}
+	if value := os.Getenv(masterKeyEnv); value != "" {
+		return cloud.ParseMasterKey([]byte(value))
+	}
+	return nil, nil
+}
+
+// encoding returns how uploaded files are compressed and encrypted.
+func encoding(c *cli.Context) (cloud.Encoding, error) {
+	enc := cloud.Encoding{Codec: c.String("compress")}
+	if err := cloud.CheckCodec(enc.Codec); err != nil {
+		return enc, err
+	}
+	if !c.Bool("encrypt") {
+		return enc, nil
+	}
+	key, err := loadMasterKey(c)
+	if err != nil {
+		return enc, err
+	}
+	if key == nil {
+		return enc, fmt.Errorf("encrypt needs master_key_file or %s", masterKeyEnv)
+	}
+	enc.Key = key
+	return enc, nil
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/job"
+)
+
+const (
+	compareSizeMtime = "size-mtime"
+	compareChecksum  = "checksum"
+)
+
+func checkCompare(mode string) error {
+	switch mode {
+	case "", compareSizeMtime, compareChecksum:
+		return nil
+	}
+	return fmt.Errorf("unknown compare mode %q, expected %s or %s", mode, compareSizeMtime, compareChecksum)
+}
+
+// keysPrefix returns the deepest "directory" shared by all keys, used to list
+// the remote side with a single request stream.
+func keysPrefix(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	prefix := keys[0]
+	for _, k := range keys[1:] {
+		for !strings.HasPrefix(k, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		return prefix[:i+1]
+	}
+	return ""
+}
+
+// remoteObjects indexes by key every object found under prefix.
+func remoteObjects(bucket, prefix string) (map[string]*s3.Object, error) {
+	objects := make(map[string]*s3.Object)
+	err := cloud.WalkObjects(s3SVC, bucket, prefix, func(o *s3.Object) bool {
+		objects[*o.Key] = o
+		return true
+	})
+	return objects, err
+}
+
+// storedAfter reports whether obj was stored after the file was last
+// modified, compared at the one second resolution of LastModified.
+func storedAfter(obj *s3.Object, fi os.FileInfo) bool {
+	return obj.LastModified != nil && !obj.LastModified.Before(fi.ModTime().Truncate(time.Second))
+}
+
+// unchanged reports whether the remote object already holds the content of
+// the local file. In size-mtime mode the object must have the same size and
+// be newer than the file; in checksum mode the ETags must match. Objects
+// stored compressed or encrypted are compared by their original size and
+// SHA-256, the one of an encrypted object by its HMAC under masterKey.
+func unchanged(mode, bucket string, partSize int64, path string, obj *s3.Object, masterKey []byte) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if aws.Int64Value(obj.Size) != fi.Size() {
+		return unchangedEncoded(mode, bucket, path, fi, obj, masterKey)
+	}
+	switch mode {
+	case compareSizeMtime:
+		return storedAfter(obj, fi), nil
+	case compareChecksum:
+		if obj.ETag == nil {
+			return false, nil
+		}
+		etag, err := cloud.LocalETag(path, partSize)
+		if err != nil {
+			return false, err
+		}
+		return cloud.SameETag(etag, *obj.ETag), nil
+	}
+	return false, nil
+}
+
+func unchangedEncoded(mode, bucket, path string, fi os.FileInfo, obj *s3.Object, masterKey []byte) (bool, error) {
+	head, err := cloud.HeadObject(s3SVC, bucket, *obj.Key)
+	if err != nil {
+		return false, err
+	}
+	if cloud.OriginalSize(head.Metadata) != fi.Size() {
+		return false, nil
+	}
+	switch mode {
+	case compareSizeMtime:
+		return storedAfter(obj, fi), nil
+	case compareChecksum:
+		sum, err := cloud.FileSHA256(path)
+		if err != nil {
+			return false, err
+		}
+		return cloud.SameSHA256(head.Metadata, masterKey, sum), nil
+	}
+	return false, nil
+}
+
+// unchangedLink reports whether the object of the symlink at path points
+// to the same target.
+func unchangedLink(bucket, path string, obj *s3.Object) (bool, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false, err
+	}
+	head, err := cloud.HeadObject(s3SVC, bucket, *obj.Key)
+	if err != nil {
+		return false, err
+	}
+	return cloud.Metadata(head.Metadata, cloud.SymlinkKey) == target, nil
+}
+
+// unchangedBatched reports whether the file at path is the one batched in
+// b: with the same size and not modified since the batch was stored. The
+// data of a batched file is in its batch until import, so its checksum is
+// not compared.
+func unchangedBatched(path string, b *job.BatchedFile) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return fi.Mode().IsRegular() && fi.Size() == b.Size && !b.Time.Before(fi.ModTime()), nil
+}
+
+// changedFiles drops from fullPath/files the entries already present in
+// objects according to mode, and the directories whose marker is. A file
+// with no object of its own is present when it is unchanged since it was
+// batched in a batch of objects. With links, symlinks are uploaded as
+// links, present when their object points to the same target. masterKey
+// checks the SHA-256 of encrypted objects.
+func changedFiles(mode, bucket string, objects map[string]*s3.Object, batched map[string]*job.BatchedFile,
+	partSize int64, fullPath, files []string, links bool, masterKey []byte) ([]string, []string, error) {
+	changedFull := make([]string, 0, len(files))
+	changed := make([]string, 0, len(files))
+	for i, file := range files {
+		if b, ok := batched[file]; ok && objects[file] == nil && objects[b.Batch] != nil {
+			same, err := unchangedBatched(fullPath[i], b)
+			if err != nil {
+				return nil, nil, err
+			}
+			if same {
+				continue
+			}
+		}
+		if obj, ok := objects[file]; ok {
+			if strings.HasSuffix(file, "/") {
+				continue
+			}
+			var same bool
+			var err error
+			if fi, lerr := os.Lstat(fullPath[i]); links && lerr == nil && fi.Mode()&os.ModeSymlink != 0 {
+				same, err = unchangedLink(bucket, fullPath[i], obj)
+			} else {
+				same, err = unchanged(mode, bucket, partSize, fullPath[i], obj, masterKey)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if same {
+				continue
+			}
+		}
+		changedFull = append(changedFull, fullPath[i])
+		changed = append(changed, file)
+	}
+	return changedFull, changed, nil
+}
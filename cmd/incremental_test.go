@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/job"
+)
+
+func TestUnchangedSizeMtime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	writeTree(t, filepath.Dir(path), map[string]string{"a.txt": "snowball"})
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 600e6, time.UTC)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	second := modTime.Truncate(time.Second)
+	tests := []struct {
+		name   string
+		stored *time.Time
+		want   bool
+	}{
+		{"stored in the same second", aws.Time(second), true},
+		{"stored later", aws.Time(second.Add(time.Second)), true},
+		{"stored the second before", aws.Time(second.Add(-time.Second)), false},
+		{"no time", nil, false},
+	}
+	for _, tt := range tests {
+		obj := &s3.Object{Key: aws.String("a.txt"), Size: aws.Int64(8), LastModified: tt.stored}
+		same, err := unchanged(compareSizeMtime, "bucket", 5, path, obj, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if same != tt.want {
+			t.Errorf("%s: unchanged = %v, want %v", tt.name, same, tt.want)
+		}
+	}
+}
+
+func TestKeysPrefix(t *testing.T) {
+	tests := []struct {
+		keys []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"a/b/c"}, "a/b/"},
+		{[]string{"a/b/c", "a/b/d", "a/bc"}, "a/"},
+		{[]string{"a", "b/c"}, ""},
+	}
+	for _, tt := range tests {
+		if got := keysPrefix(tt.keys); got != tt.want {
+			t.Errorf("keysPrefix(%q) = %q, want %q", tt.keys, got, tt.want)
+		}
+	}
+}
+
+func TestChangedFilesBatched(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc", "d": "dddd"})
+	now := time.Now()
+	batch := "bk/" + job.BatchKeyPrefix + "run-00001.tar"
+	objects := map[string]*s3.Object{batch: {Key: aws.String(batch)}}
+	batched := map[string]*job.BatchedFile{
+		"bk/a": {Key: "bk/a", Batch: batch, Size: 4, Time: now.Add(time.Minute)},
+		// changed since it was batched
+		"bk/b": {Key: "bk/b", Batch: batch, Size: 3, Time: now.Add(time.Minute)},
+		"bk/c": {Key: "bk/c", Batch: batch, Size: 4, Time: now.Add(-time.Minute)},
+		// its batch is gone
+		"bk/d": {Key: "bk/d", Batch: "bk/" + job.BatchKeyPrefix + "old-00001.tar", Size: 4, Time: now.Add(time.Minute)},
+	}
+	var fullPath, files []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		fullPath = append(fullPath, filepath.Join(dir, name))
+		files = append(files, "bk/"+name)
+	}
+	for _, mode := range []string{compareSizeMtime, compareChecksum} {
+		_, changed, err := changedFiles(mode, "bucket", objects, batched, 5, fullPath, files, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"bk/b", "bk/c", "bk/d"}; !reflect.DeepEqual(changed, want) {
+			t.Errorf("%s: changed %q, want %q", mode, changed, want)
+		}
+	}
+}
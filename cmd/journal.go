@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// resumeRun returns the id of the resumed sync run, the latest one when id
+// is empty, and the files it left unfinished.
+func resumeRun(stateDir, id string, failedOnly bool) (string, []string, []string, error) {
+	var err error
+	if id == "" {
+		if id, err = job.LatestRun(stateDir, job.RunSync); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	journal, err := job.OpenJournal(stateDir, id)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer journal.Close()
+	if journal.Kind != "" && journal.Kind != job.RunSync {
+		return "", nil, nil, fmt.Errorf("run %s is a %s run, not a sync one", id, journal.Kind)
+	}
+
+	entries := journal.Unfinished(failedOnly)
+	fullPath := make([]string, 0, len(entries))
+	files := make([]string, 0, len(entries))
+	for _, e := range entries {
+		fullPath = append(fullPath, e.Src)
+		files = append(files, e.Dst)
+	}
+	fmt.Printf("resuming run %s, %d files left\n", id, len(files))
+	return id, fullPath, files, nil
+}
+
+// syncJournal opens the journal a run of kind records its progress in: the
+// resumed run id, or a new one listing every file as pending.
+func syncJournal(stateDir, kind, id string, fullPath, files []string) (*job.Journal, error) {
+	if id != "" {
+		return job.OpenJournal(stateDir, id)
+	}
+	journal, err := job.NewJournal(stateDir, kind)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if err := journal.Add(fullPath[i], files[i]); err != nil {
+			journal.Close()
+			return nil, err
+		}
+	}
+	return journal, nil
+}
+
+// retryPolicy returns the retry policy of the tasks set by the flags.
+func retryPolicy(c *cli.Context) job.RetryPolicy {
+	retry := job.DefaultRetry
+	retry.Attempts = c.Int("retries")
+	retry.Backoff = c.Duration("retry-backoff")
+	return retry
+}
+
+// runTasks submits tasks to pool and returns their results once they are
+// all done. The tasks left when the pool is interrupted are not submitted.
+func runTasks(pool *job.Pool, tasks []job.Task) []job.Result {
+	go func() {
+		for _, task := range tasks {
+			if !pool.Submit(task) {
+				break
+			}
+		}
+		pool.Close()
+	}()
+	var results []job.Result
+	for res := range pool.Results() {
+		results = append(results, res)
+	}
+	return results
+}
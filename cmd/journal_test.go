@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/iandri/snowball/job"
+)
+
+func TestResumeRun(t *testing.T) {
+	dir := t.TempDir()
+	run, err := syncJournal(dir, job.RunSync, "", []string{"/src/a", "/src/b", "/src/c"}, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Done("/src/a", 1)
+	run.Failed("/src/b", errors.New("no such file"))
+	run.Close()
+	restore, err := syncJournal(dir, job.RunRestore, "", []string{"k"}, []string{"/dst/k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore.Close()
+
+	tests := []struct {
+		id         string
+		failedOnly bool
+		fullPath   []string
+		files      []string
+	}{
+		{run.ID, false, []string{"/src/b", "/src/c"}, []string{"b", "c"}},
+		{run.ID, true, []string{"/src/b"}, []string{"b"}},
+		// the latest sync run, the restore run being skipped
+		{"", true, []string{"/src/b"}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		id, fullPath, files, err := resumeRun(dir, tt.id, tt.failedOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != run.ID || !reflect.DeepEqual(fullPath, tt.fullPath) || !reflect.DeepEqual(files, tt.files) {
+			t.Errorf("resumeRun(%q, %v) = %s, %q, %q", tt.id, tt.failedOnly, id, fullPath, files)
+		}
+	}
+	if _, _, _, err := resumeRun(dir, restore.ID, false); err == nil {
+		t.Error("restore run resumed by sync")
+	}
+	if _, _, _, err := resumeRun(dir, "nope", false); err == nil {
+		t.Error("unknown run resumed")
+	}
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// keyVars are the variables of a --key-template.
+type keyVars struct {
+	// Date is the UTC day the run started, Host the name of this machine.
+	Date string
+	Host string
+	// Path is the local path of the file and RelPath its key so far: the
+	// path without the source root, rewritten by the rules.
+	Path    string
+	RelPath string
+	Dir     string
+	Base    string
+	Ext     string
+}
+
+// rewriteRule replaces the matches of re in a key with repl, which may
+// refer to the groups of re as $1 or ${name}.
+type rewriteRule struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// keyMapper turns the path of a local file into its key: the source root
+// is stripped, the rewrite rules applied in order, the template executed
+// and the destination prefix added.
+type keyMapper struct {
+	root     string
+	prefix   string
+	rules    []rewriteRule
+	template *template.Template
+	vars     keyVars
+}
+
+// newKeyMapper returns the mapper set by the flags of c, or nil when none
+// is set and the keys are the ones made by scanDir.
+func newKeyMapper(c *cli.Context) (*keyMapper, error) {
+	if c.String("strip-root") == "" && c.String("dst-prefix") == "" && len(c.StringSlice("rewrite")) == 0 &&
+		c.String("key-template") == "" {
+		return nil, nil
+	}
+	m := &keyMapper{prefix: strings.Trim(c.String("dst-prefix"), "/")}
+	if root := c.String("strip-root"); root != "" {
+		m.root = filepath.Clean(root)
+	}
+	for _, rule := range c.StringSlice("rewrite") {
+		i := strings.Index(rule, "=>")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid rewrite %q, expected regex=>replacement", rule)
+		}
+		re, err := regexp.Compile(rule[:i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite %q: %v", rule, err)
+		}
+		m.rules = append(m.rules, rewriteRule{re: re, repl: rule[i+2:]})
+	}
+	if text := c.String("key-template"); text != "" {
+		tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key-template: %v", err)
+		}
+		m.template = tmpl
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	m.vars = keyVars{Date: time.Now().UTC().Format("2006-01-02"), Host: host}
+	return m, nil
+}
+
+// key returns the key of the file at fullPath, whose key made by scanDir
+// is file. The key of a directory keeps its trailing slash.
+func (m *keyMapper) key(fullPath, file string) (string, error) {
+	rel := file
+	if m.root != "" {
+		var err error
+		if rel, err = filepath.Rel(m.root, fullPath); err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("%s is not under strip-root %s", fullPath, m.root)
+		}
+	}
+	rel = strings.TrimLeft(filepath.ToSlash(rel), "/")
+	for _, rule := range m.rules {
+		rel = rule.re.ReplaceAllString(rel, rule.repl)
+	}
+	key := rel
+	if m.template != nil {
+		vars := m.vars
+		vars.Path = fullPath
+		vars.RelPath = rel
+		vars.Dir = path.Dir(rel)
+		vars.Base = path.Base(rel)
+		vars.Ext = path.Ext(rel)
+		var buf bytes.Buffer
+		if err := m.template.Execute(&buf, vars); err != nil {
+			return "", fmt.Errorf("key-template for %s: %v", fullPath, err)
+		}
+		key = buf.String()
+	}
+	if m.prefix != "" {
+		key = m.prefix + "/" + key
+	}
+	key = strings.TrimLeft(path.Clean("/"+key), "/")
+	if key == "" {
+		return "", fmt.Errorf("%s maps to an empty key", fullPath)
+	}
+	if strings.HasSuffix(file, "/") {
+		key += "/"
+	}
+	return key, nil
+}
+
+// mapKeys replaces files, the keys made by scanDir for fullPath, with the
+// ones of m. Two files mapped to the same key are an error, one would
+// overwrite the other.
+func (m *keyMapper) mapKeys(fullPath, files []string) ([]string, error) {
+	keys := make([]string, len(files))
+	owner := make(map[string]string, len(files))
+	for i, file := range files {
+		key, err := m.key(fullPath[i], file)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := owner[key]; ok {
+			return nil, fmt.Errorf("%s and %s both map to the key %s", other, fullPath[i], key)
+		}
+		owner[key] = fullPath[i]
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// destPrefix returns the prefix under which m puts every key: the
+// destination prefix, narrowed to the common directory of keys when rules
+// or a template may put them anywhere under it.
+func (m *keyMapper) destPrefix(keys []string) string {
+	if len(keys) > 0 && (m.template != nil || len(m.rules) > 0) {
+		return keysPrefix(keys)
+	}
+	if m.prefix == "" {
+		return ""
+	}
+	return m.prefix + "/"
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"regexp"
+	"testing"
+	"text/template"
+)
+
+func testMapper(root, prefix string, rules [][2]string, tmpl string) *keyMapper {
+	m := &keyMapper{root: root, prefix: prefix, vars: keyVars{Date: "2024-05-01", Host: "box"}}
+	for _, rule := range rules {
+		m.rules = append(m.rules, rewriteRule{re: regexp.MustCompile(rule[0]), repl: rule[1]})
+	}
+	if tmpl != "" {
+		m.template = template.Must(template.New("key").Option("missingkey=error").Parse(tmpl))
+	}
+	return m
+}
+
+func TestKeyMapperKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		mapper   *keyMapper
+		fullPath string
+		file     string
+		want     string
+		err      bool
+	}{
+		{"as scanned", testMapper("", "", nil, ""), "data/a/b.txt", "data/a/b.txt", "data/a/b.txt", false},
+		{"dst prefix", testMapper("", "backup", nil, ""), "data/a.txt", "data/a.txt", "backup/data/a.txt", false},
+		{"strip root", testMapper("/srv/data", "", nil, ""), "/srv/data/a/b.txt", "/srv/data/a/b.txt",
+			"a/b.txt", false},
+		{"name starting with dots", testMapper("/srv/data", "", nil, ""), "/srv/data/..foo", "/srv/data/..foo",
+			"..foo", false},
+		{"outside strip root", testMapper("/srv/data", "", nil, ""), "/srv/other/a.txt", "/srv/other/a.txt",
+			"", true},
+		{"sibling of strip root", testMapper("/srv/data", "", nil, ""), "/srv/data2/a.txt", "/srv/data2/a.txt",
+			"", true},
+		{"strip root itself", testMapper("/srv/data", "", nil, ""), "/srv/data", "/srv/data/", "", true},
+		{"rules in order", testMapper("", "", [][2]string{{`^logs/`, "archive/"}, {`archive/(\d+)`, "old/$1"}}, ""),
+			"logs/2024.gz", "logs/2024.gz", "old/2024.gz", false},
+		{"template", testMapper("", "dst", nil, "{{.Host}}/{{.Date}}/{{.Dir}}/{{.Base}}"),
+			"/home/u/a/b.tar", "a/b.tar", "dst/box/2024-05-01/a/b.tar", false},
+		{"template with missing field", testMapper("", "", nil, "{{.Nope}}"), "a", "a", "", true},
+		{"cleaned", testMapper("", "/p/", [][2]string{{`x`, "/../"}}, ""), "axb", "axb", "p/b", false},
+		{"empty key", testMapper("", "", [][2]string{{`.*`, ""}}, ""), "a", "a", "", true},
+		{"directory", testMapper("/srv", "p", nil, ""), "/srv/empty", "/srv/empty/", "p/empty/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.mapper.key(tt.fullPath, tt.file)
+			if (err != nil) != tt.err {
+				t.Fatalf("key(%s) error = %v, want error %v", tt.fullPath, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("key(%s) = %q, want %q", tt.fullPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyMapperMapKeys(t *testing.T) {
+	m := testMapper("", "", [][2]string{{`\.tmp$`, ""}}, "")
+	keys, err := m.mapKeys([]string{"a.txt", "b.tmp"}, []string{"a.txt", "b.tmp"})
+	if err != nil || len(keys) != 2 || keys[0] != "a.txt" || keys[1] != "b" {
+		t.Errorf("mapKeys = %q, %v", keys, err)
+	}
+	if _, err := m.mapKeys([]string{"b", "b.tmp"}, []string{"b", "b.tmp"}); err == nil {
+		t.Error("two files mapped to the same key")
+	}
+}
+
+func TestKeyMapperDestPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		mapper *keyMapper
+		keys   []string
+		want   string
+	}{
+		{"no prefix", testMapper("/srv", "", nil, ""), []string{"a/b", "a/c"}, ""},
+		{"prefix", testMapper("/srv", "backup", nil, ""), []string{"backup/a/b"}, "backup/"},
+		{"rules", testMapper("", "backup", [][2]string{{"x", "y"}}, ""), []string{"backup/a/b", "backup/a/c"},
+			"backup/a/"},
+		{"template spread", testMapper("", "", nil, "{{.Base}}"), []string{"b", "c"}, ""},
+		{"template without keys", testMapper("", "backup", nil, "{{.Base}}"), nil, "backup/"},
+	}
+	for _, tt := range tests {
+		if got := tt.mapper.destPrefix(tt.keys); got != tt.want {
+			t.Errorf("%s: destPrefix = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// destPrefix returns the prefix all the keys sync derives from src fall
+// under: the --prefix directory, or the source directory itself.
+func destPrefix(src, prefix string) string {
+	if prefix != "" {
+		return prefix + "/"
+	}
+	src = filepath.Clean(src)
+	if src == "." {
+		return ""
+	}
+	return src + "/"
+}
+
+// syncDestination returns the prefix the keys files of a sync run set by
+// the flags of c fall under, mapped by mapper when set. Its batches are
+// stored there too.
+func syncDestination(c *cli.Context, mapper *keyMapper, files []string) string {
+	if mapper != nil {
+		return mapper.destPrefix(files)
+	}
+	return destPrefix(c.String("src"), c.String("prefix"))
+}
+
+// plannedDeletions returns the keys of objects with no local file left.
+// The objects of the files and directories skipped by the scan, excluded
+// or filtered out, are kept: they still exist, they are just not synced.
+// So are the objects under prefix whose path relative to it is excluded by
+// paths, when set, like rsync does. With a filter, only the keys it
+// matches are considered, the others never were sync's to manage.
+func plannedDeletions(objects map[string]*s3.Object, files []string, skipped *skippedPaths, mapper *keyMapper,
+	prefix string, paths *pathFilter, filter string) ([]string, error) {
+	var filterRe *regexp.Regexp
+	if filter != "" {
+		filterRe = regexp.MustCompile(filter)
+	}
+	local := make(map[string]bool, len(files))
+	for _, file := range files {
+		local[file] = true
+	}
+	var skippedDirs []string
+	if skipped != nil {
+		for i, key := range skipped.files {
+			if mapper != nil {
+				var err error
+				if key, err = mapper.key(skipped.fullPath[i], key); err != nil {
+					continue
+				}
+			}
+			if strings.HasSuffix(key, "/") {
+				skippedDirs = append(skippedDirs, key)
+			} else {
+				local[key] = true
+			}
+		}
+	}
+	var keys []string
+	for key := range objects {
+		if local[key] || strings.HasSuffix(key, "/") || job.IsBatchKey(key) ||
+			underAny(key, skippedDirs) {
+			continue
+		}
+		if filterRe != nil && !filterRe.MatchString(key) {
+			continue
+		}
+		if paths != nil && strings.HasPrefix(key, prefix) {
+			excluded, err := paths.excluded(strings.TrimPrefix(key, prefix))
+			if err != nil {
+				return nil, err
+			}
+			if excluded {
+				continue
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// underAny reports whether key is under one of the directory keys dirs.
+func underAny(key string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(key, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDeletions refuses a deletion plan over the absolute or percentage
+// limits, a zero limit disabling the check.
+func checkDeletions(count, total, maxCount int, maxPercent float64) error {
+	if maxCount > 0 && count > maxCount {
+		return fmt.Errorf("refusing to delete %d objects, more than --delete-max %d", count, maxCount)
+	}
+	if maxPercent > 0 && total > 0 {
+		if percent := float64(count) * 100 / float64(total); percent > maxPercent {
+			return fmt.Errorf("refusing to delete %d of %d objects (%.1f%%), more than --delete-max-percent %.1f%%",
+				count, total, percent, maxPercent)
+		}
+	}
+	return nil
+}
+
+// deleteObjects deletes keys of bucket with pool, or only prints them when
+// dry is set, and returns how many were deleted and those that were not.
+func deleteObjects(pool *job.Pool, bucket string, keys []string, dry bool) (int, []job.DeleteFailure) {
+	if dry {
+		for _, key := range keys {
+			fmt.Printf("deleting s3://%s/%s\n", bucket, key)
+		}
+		return 0, nil
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	transfer := job.Transfer{Engine: engine, Bucket: bucket}
+	var deleted int
+	var failures []job.DeleteFailure
+	for _, res := range runTasks(pool, job.DeleteTasks(transfer, keys)) {
+		task := res.Task.(*job.Delete)
+		if res.Err != nil {
+			fmt.Printf("%d keys not deleted: %v\n", len(task.Keys), res.Err)
+			for _, key := range task.Keys {
+				failures = append(failures, job.DeleteFailure{Key: key, Error: res.Err.Error()})
+			}
+			continue
+		}
+		for _, e := range task.Output.Errors {
+			fmt.Printf("Key %s not deleted: %s\n", *e.Key, *e.Message)
+			failures = append(failures, job.DeleteFailure{Key: aws.StringValue(e.Key), Error: aws.StringValue(e.Message)})
+		}
+		deleted += len(task.Output.Deleted)
+	}
+	fmt.Printf("%d objects deleted\n", deleted)
+	return deleted, failures
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/job"
+)
+
+func TestPlannedDeletions(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".snowballignore": "cache/\n",
+		"keep.txt":        "",
+		"old.txt":         "",
+		"build/out.o":     "",
+		"cache/blob":      "",
+		"sub/ignored.tmp": "",
+		"sub/synced.txt":  "",
+	})
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "old.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	filter := newPathFilter(root, testRules(t, "-*.o", "-*.tmp"), ".snowballignore")
+	attrs := &attrFilter{types: map[string]bool{typeFile: true}, newerThan: time.Now().Add(-time.Hour)}
+	mapper := testMapper(root, "bk", nil, "")
+	skipped := &skippedPaths{}
+	fullPath, files, err := scanDir(root, "", "", filter, attrs, false, skipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err = mapper.mapKeys(fullPath, files); err != nil {
+		t.Fatal(err)
+	}
+
+	objects := make(map[string]*s3.Object)
+	for _, key := range []string{
+		"bk/keep.txt", "bk/sub/synced.txt",
+		// skipped by the filters but still on disk
+		"bk/old.txt", "bk/build/out.o", "bk/sub/ignored.tmp", "bk/cache/blob", "bk/cache/deep/blob",
+		// markers and batches are never deleted
+		"bk/empty/", "bk/" + job.BatchKeyPrefix + "run-00001.tar",
+		// gone from the disk, the last one excluded
+		"bk/gone.txt", "bk/sub/gone.log", "bk/build/gone.o", "bk/cache/gone",
+	} {
+		objects[key] = &s3.Object{}
+	}
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"", []string{"bk/gone.txt", "bk/sub/gone.log"}},
+		{`\.log$`, []string{"bk/sub/gone.log"}},
+	}
+	for _, tt := range tests {
+		got, err := plannedDeletions(objects, files, skipped, mapper, "bk/", filter, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("plannedDeletions with filter %q = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+	// without the rules, only what the scan skipped is kept
+	got, err := plannedDeletions(objects, files, skipped, mapper, "bk/", nil, "")
+	want := []string{"bk/build/gone.o", "bk/gone.txt", "bk/sub/gone.log"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("plannedDeletions without rules = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestCheckDeletions(t *testing.T) {
+	tests := []struct {
+		count, total, max int
+		percent           float64
+		err               bool
+	}{
+		{0, 0, 10, 10, false},
+		{5, 100, 10, 10, false},
+		{11, 1000, 10, 0, true},
+		{11, 100, 0, 10, true},
+		{10, 100, 0, 10, false},
+		{100, 100, 0, 0, false},
+	}
+	for _, tt := range tests {
+		err := checkDeletions(tt.count, tt.total, tt.max, tt.percent)
+		if (err != nil) != tt.err {
+			t.Errorf("checkDeletions(%d, %d, %d, %.0f) = %v, want error %v", tt.count, tt.total, tt.max, tt.percent,
+				err, tt.err)
+		}
+	}
+}
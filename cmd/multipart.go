@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/iandri/snowball/cloud"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// uploadFilter selects multipart uploads by key, prefix and age. Empty
+// fields match every upload.
+type uploadFilter struct {
+	key       string
+	prefix    string
+	olderThan time.Duration
+}
+
+func (f uploadFilter) match(u *cloud.MultipartUpload, now time.Time) bool {
+	if f.key != "" && u.Key != f.key {
+		return false
+	}
+	if !strings.HasPrefix(u.Key, f.prefix) {
+		return false
+	}
+	return f.olderThan <= 0 || now.Sub(u.Initiated) > f.olderThan
+}
+
+// matchingUploads lists the multipart uploads of bucket selected by f.
+func matchingUploads(bucket string, f uploadFilter) ([]*cloud.MultipartUpload, error) {
+	prefix := f.prefix
+	if f.key != "" {
+		prefix = f.key
+	}
+	uploads, err := cloud.ListMultipartUploads(s3SVC, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var matching []*cloud.MultipartUpload
+	for _, u := range uploads {
+		if f.match(u, now) {
+			matching = append(matching, u)
+		}
+	}
+	return matching, nil
+}
+
+// abortUploads aborts uploads, or only prints them when dry. The uploads
+// kept under stateDir for resuming are skipped unless stateDir is empty.
+func abortUploads(bucket, stateDir string, uploads []*cloud.MultipartUpload, dry bool) error {
+	var aborted, failed int
+	var freed int64
+	for _, u := range uploads {
+		if stateDir != "" && cloud.SavedUploadID(stateDir, bucket, u.Key) == u.UploadID {
+			fmt.Printf("keeping upload %s of %s, resumed from %s\n", u.UploadID, u.Key, stateDir)
+			continue
+		}
+		if dry {
+			fmt.Printf("aborting upload %s of s3://%s/%s, %d parts, %s\n", u.UploadID, bucket, u.Key, u.Parts,
+				humanize.Bytes(uint64(u.Size)))
+			continue
+		}
+		if err := cloud.AbortMultipartUpload(s3SVC, bucket, u.Key, u.UploadID); err != nil {
+			log.Printf("upload %s of %s not aborted: %v\n", u.UploadID, u.Key, err)
+			failed++
+			continue
+		}
+		aborted++
+		freed += u.Size
+	}
+	if !dry {
+		fmt.Printf("%d multipart uploads aborted, %s freed\n", aborted, humanize.Bytes(uint64(freed)))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d multipart uploads could not be aborted", failed)
+	}
+	return nil
+}
+
+func commandMultipartList(c *cli.Context) error {
+	if err := checkFlags(c); err != nil {
+		return err
+	}
+	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
+		c.GlobalString("aws_region"), c.Bool("verbose"))
+	uploads, err := matchingUploads(c.String("bucket"), uploadFilter{prefix: c.String("prefix"),
+		olderThan: c.Duration("older-than")})
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, u := range uploads {
+		fmt.Printf("Key: %15s, UploadId: %s, Initiated: %s, Parts: %d, Size: %d\n", u.Key, u.UploadID,
+			u.Initiated.Format(time.RFC3339), u.Parts, u.Size)
+		total += u.Size
+	}
+	fmt.Printf("%d multipart uploads, %s\n", len(uploads), humanize.Bytes(uint64(total)))
+	return nil
+}
+
+func commandMultipartAbort(c *cli.Context) error {
+	if c.NumFlags() == 0 {
+		cli.ShowSubcommandHelp(c)
+		os.Exit(1)
+	}
+	if err := checkFlags(c); err != nil {
+		return err
+	}
+	f := uploadFilter{key: c.String("key"), prefix: c.String("prefix"), olderThan: c.Duration("older-than")}
+	if f.key == "" && f.prefix == "" && f.olderThan <= 0 {
+		return fmt.Errorf("key, prefix or older-than is missing")
+	}
+	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
+		c.GlobalString("aws_region"), c.Bool("verbose"))
+	uploads, err := matchingUploads(c.String("bucket"), f)
+	if err != nil {
+		return err
+	}
+	return abortUploads(c.String("bucket"), "", uploads, c.Bool("dry"))
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/cloud/s3test"
+)
+
+func TestUploadFilterMatch(t *testing.T) {
+	now := time.Now()
+	u := &cloud.MultipartUpload{Key: "bk/a", Initiated: now.Add(-2 * time.Hour)}
+	tests := []struct {
+		name   string
+		filter uploadFilter
+		want   bool
+	}{
+		{"empty", uploadFilter{}, true},
+		{"key", uploadFilter{key: "bk/a"}, true},
+		{"other key", uploadFilter{key: "bk/b"}, false},
+		{"key prefix", uploadFilter{key: "bk/"}, false},
+		{"prefix", uploadFilter{prefix: "bk/"}, true},
+		{"other prefix", uploadFilter{prefix: "other/"}, false},
+		{"older", uploadFilter{olderThan: time.Hour}, true},
+		{"newer", uploadFilter{olderThan: 3 * time.Hour}, false},
+		{"key and prefix", uploadFilter{key: "bk/a", prefix: "other/"}, false},
+		{"prefix and newer", uploadFilter{prefix: "bk/", olderThan: 3 * time.Hour}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.match(u, now); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAbortUploads(t *testing.T) {
+	srv := s3test.NewServer("test")
+	defer srv.Close()
+	saved := s3SVC
+	defer func() { s3SVC = saved }()
+	s3SVC = srv.Client()
+	dir := t.TempDir()
+
+	// an upload left by a failed sync, kept to be resumed
+	data := make([]byte, 3*1024*1024)
+	rand.Read(data)
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv.Tamper = func(key string, part int64, data []byte) []byte {
+		if part == 2 {
+			data[0] ^= 1
+		}
+		return data
+	}
+	opts := cloud.Options{PartSize: 1, Concurrency: 1, StateDir: dir}
+	if _, err := cloud.NewEngine(s3SVC).Upload("test", src, "bk/resumed", opts); err == nil {
+		t.Fatal("upload of a part stored wrong succeeded")
+	}
+	resumed := cloud.SavedUploadID(dir, "test", "bk/resumed")
+	if resumed == "" {
+		t.Fatal("no upload state kept after the failure")
+	}
+	stale := srv.StartUpload("test", "bk/stale", time.Now().Add(-48*time.Hour), []byte("part"))
+	srv.StartUpload("test", "other/stale", time.Now().Add(-48*time.Hour))
+
+	// abort-stale of a sync: only the old uploads under its prefix
+	uploads, err := matchingUploads("test", uploadFilter{prefix: "bk/", olderThan: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 || uploads[0].UploadID != stale {
+		t.Fatalf("stale uploads %v, want only %s", uploads, stale)
+	}
+
+	uploads, err = matchingUploads("test", uploadFilter{prefix: "bk/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 2 {
+		t.Fatalf("%d uploads under bk/, want 2", len(uploads))
+	}
+	if err := abortUploads("test", dir, uploads, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Requests("AbortMultipartUpload"); n != 0 {
+		t.Fatalf("dry run aborted %d uploads", n)
+	}
+	if err := abortUploads("test", dir, uploads, false); err != nil {
+		t.Fatal(err)
+	}
+	left := srv.Uploads("test")
+	ids := make(map[string]bool)
+	for _, u := range left {
+		ids[u.ID] = true
+	}
+	if len(left) != 2 || !ids[resumed] || ids[stale] {
+		t.Errorf("uploads left %v, want the resumed %s and the one outside bk/", ids, resumed)
+	}
+}
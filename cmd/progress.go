@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/iandri/snowball/utils"
+	"gopkg.in/cheggaaa/pb.v1"
+)
+
+// progressLogInterval is how often the progress is logged when stdout is
+// not a terminal.
+const progressLogInterval = 30 * time.Second
+
+// workerProgress is the file a worker is moving.
+type workerProgress struct {
+	name string
+	size int64
+	done int64
+	bar  *pb.ProgressBar
+}
+
+// progress shows the bytes moved by a run against the total: as a bar with
+// the throughput and the time left on a terminal, with a line per worker in
+// detail mode, else as periodic log lines. It is the job.Monitor of the run.
+type progress struct {
+	total    int64
+	done     int64
+	files    int
+	finished int
+	start    time.Time
+
+	mu      sync.Mutex
+	workers map[int]*workerProgress
+	bar     *pb.ProgressBar
+	pool    *pb.Pool
+	stop    chan struct{}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgress starts showing the progress of files totalling total bytes,
+// moved by forks workers.
+func newProgress(total int64, files, forks int, detail bool) *progress {
+	p := &progress{total: total, files: files, start: time.Now(), workers: make(map[int]*workerProgress),
+		stop: make(chan struct{})}
+	if !isTerminal(os.Stdout) {
+		go p.logLoop()
+		return p
+	}
+	p.bar = pb.New64(total).SetUnits(pb.U_BYTES)
+	p.bar.ShowSpeed = true
+	p.bar.ShowTimeLeft = true
+	p.bar.Postfix(p.filesText())
+	if detail {
+		bars := []*pb.ProgressBar{p.bar}
+		for i := 1; i <= forks; i++ {
+			w := &workerProgress{bar: pb.New64(0).SetUnits(pb.U_BYTES)}
+			w.bar.ShowTimeLeft = false
+			w.bar.Prefix(fmt.Sprintf("worker%-3d idle ", i))
+			p.workers[i] = w
+			bars = append(bars, w.bar)
+		}
+		pool, err := pb.StartPool(bars...)
+		if err == nil {
+			p.pool = pool
+			return p
+		}
+		log.Println(err)
+	}
+	p.bar.Start()
+	return p
+}
+
+func (p *progress) filesText() string {
+	return fmt.Sprintf(" %d/%d files", p.finished, p.files)
+}
+
+func (p *progress) worker(id int) *workerProgress {
+	w, ok := p.workers[id]
+	if !ok {
+		w = &workerProgress{}
+		p.workers[id] = w
+	}
+	return w
+}
+
+func (p *progress) add(n int64) {
+	atomic.AddInt64(&p.done, n)
+	if p.bar != nil {
+		p.bar.Add64(n)
+	}
+}
+
+func (p *progress) Start(id int, name string, size int64) {
+	p.mu.Lock()
+	w := p.worker(id)
+	retracted := w.done
+	w.name, w.size, w.done = name, size, 0
+	if w.bar != nil {
+		w.bar.Total = size
+		w.bar.Set64(0)
+		w.bar.Prefix(fmt.Sprintf("worker%-3d %-30.30s ", id, filepath.Base(name)))
+	}
+	p.mu.Unlock()
+	p.add(-retracted)
+}
+
+func (p *progress) Add(id int, n int64) {
+	p.mu.Lock()
+	w := p.worker(id)
+	w.done += n
+	if w.bar != nil {
+		w.bar.Add64(n)
+	}
+	p.mu.Unlock()
+	p.add(n)
+}
+
+func (p *progress) Finish(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	w := p.worker(id)
+	w.name, w.size, w.done = "", 0, 0
+	if w.bar != nil {
+		w.bar.Total = 0
+		w.bar.Set64(0)
+		w.bar.Prefix(fmt.Sprintf("worker%-3d idle ", id))
+	}
+	p.finished++
+	if p.bar != nil {
+		p.bar.Postfix(p.filesText())
+	}
+}
+
+// line describes the progress for a log line.
+func (p *progress) line(rate float64) string {
+	done := atomic.LoadInt64(&p.done)
+	var percent float64
+	if p.total > 0 {
+		percent = float64(done) * 100 / float64(p.total)
+	}
+	eta := "unknown"
+	if average := float64(done) / time.Since(p.start).Seconds(); average > 0 && done <= p.total {
+		eta = utils.HumanizeDuration(time.Duration(float64(p.total-done) / average * float64(time.Second)))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	inFlight := 0
+	for _, w := range p.workers {
+		if w.name != "" {
+			inFlight++
+		}
+	}
+	return fmt.Sprintf("progress: %s of %s (%.1f%%), %s/s, %s left, %d/%d files, %d in flight",
+		humanize.Bytes(uint64(done)), humanize.Bytes(uint64(p.total)), percent, humanize.Bytes(uint64(rate)),
+		eta, p.finished, p.files, inFlight)
+}
+
+func (p *progress) logLoop() {
+	ticker := time.NewTicker(progressLogInterval)
+	defer ticker.Stop()
+	last := atomic.LoadInt64(&p.done)
+	for {
+		select {
+		case <-ticker.C:
+			done := atomic.LoadInt64(&p.done)
+			log.Println(p.line(float64(done-last) / progressLogInterval.Seconds()))
+			last = done
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// finish stops showing the progress and prints msg.
+func (p *progress) finish(msg string) {
+	close(p.stop)
+	switch {
+	case p.pool != nil:
+		p.bar.Finish()
+		for _, w := range p.workers {
+			w.bar.Finish()
+		}
+		p.pool.Stop()
+		fmt.Println(msg)
+	case p.bar != nil:
+		p.bar.FinishPrint(msg)
+	default:
+		fmt.Println(msg)
+	}
+}
+
+// localBytes returns the total size of paths.
+func localBytes(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			total += fi.Size()
+		}
+	}
+	return total
+}
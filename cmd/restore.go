@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// restorePath maps a key back to a file under dst, the prefix removed. It
+// returns false for keys that would land outside dst and, when prefix does
+// not end with a slash, for the keys it is not a whole path component of.
+func restorePath(dst, prefix, key string) (string, bool) {
+	rel := strings.TrimPrefix(key, prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") && !strings.HasPrefix(rel, "/") {
+		return "", false
+	}
+	rel = strings.TrimPrefix(rel, "/")
+	path := filepath.Join(dst, rel)
+	root := filepath.Clean(dst)
+	if rel == "" || !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
+
+// restored reports whether the local file already holds the object: same
+// size and written after it, or with the same ETag in checksum mode.
+// Compressed or encrypted objects are compared by their original size and
+// SHA-256, the one of an encrypted object by its HMAC under masterKey.
+// With preserve, the file was given the modification time kept with the
+// object, which it must still have. A directory marker is restored once
+// the directory exists.
+func restored(mode, bucket string, partSize int64, path string, obj *s3.Object, masterKey []byte,
+	preserve bool) (bool, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if strings.HasSuffix(*obj.Key, "/") {
+		return fi.IsDir(), nil
+	}
+	if preserve && mode == compareSizeMtime {
+		head, err := cloud.HeadObject(s3SVC, bucket, *obj.Key)
+		if err != nil {
+			return false, err
+		}
+		meta, err := cloud.DecodeFileMetadata(head.Metadata)
+		if err != nil || meta == nil {
+			return false, err
+		}
+		if meta.Symlink != "" {
+			target, err := os.Readlink(path)
+			return err == nil && target == meta.Symlink, nil
+		}
+		size := aws.Int64Value(obj.Size)
+		if original := cloud.OriginalSize(head.Metadata); original >= 0 {
+			size = original
+		}
+		return fi.Size() == size && fi.ModTime().Equal(meta.ModTime), nil
+	}
+	if fi.Size() != aws.Int64Value(obj.Size) {
+		head, err := cloud.HeadObject(s3SVC, bucket, *obj.Key)
+		if err != nil {
+			return false, err
+		}
+		if cloud.OriginalSize(head.Metadata) != fi.Size() {
+			return false, nil
+		}
+		if mode == compareChecksum {
+			sum, err := cloud.FileSHA256(path)
+			if err != nil {
+				return false, err
+			}
+			return cloud.SameSHA256(head.Metadata, masterKey, sum), nil
+		}
+	}
+	switch mode {
+	case compareSizeMtime:
+		return !fi.ModTime().Before(aws.TimeValue(obj.LastModified)), nil
+	case compareChecksum:
+		etag, err := cloud.LocalETag(path, partSize)
+		if err != nil {
+			return false, err
+		}
+		return cloud.SameETag(etag, aws.StringValue(obj.ETag)), nil
+	}
+	return false, nil
+}
+
+func commandRestore(c *cli.Context) error {
+	if c.NumFlags() == 0 {
+		cli.ShowSubcommandHelp(c)
+		os.Exit(1)
+	}
+	if err := checkFlags(c); err != nil {
+		return err
+	}
+	if err := limitBandwidth(c); err != nil {
+		return err
+	}
+	if c.String("dst") == "" {
+		return fmt.Errorf("dst is missing")
+	}
+	if err := checkCompare(c.String("compare")); err != nil {
+		return err
+	}
+	masterKey, err := loadMasterKey(c)
+	if err != nil {
+		return err
+	}
+	opts, err := transferOptions(c, cloud.Encoding{Key: masterKey})
+	if err != nil {
+		return err
+	}
+	initialize(c.GlobalString("aws_id"), c.GlobalString("aws_key"), c.GlobalString("aws_endpoint"),
+		c.GlobalString("aws_region"), c.Bool("verbose"))
+
+	var keys, paths []string
+	var sizes []int64
+	var skipped int
+	var walkErr error
+	err = cloud.WalkObjects(s3SVC, c.String("bucket"), c.String("prefix"), func(o *s3.Object) bool {
+		if strings.HasSuffix(*o.Key, "/") && !c.Bool("preserve") {
+			return true
+		}
+		path, ok := restorePath(c.String("dst"), c.String("prefix"), *o.Key)
+		if !ok {
+			log.Printf("skipping %s, not under %s or outside of %s\n", *o.Key, c.String("prefix"), c.String("dst"))
+			return true
+		}
+		if c.String("compare") != "" {
+			same, err := restored(c.String("compare"), c.String("bucket"), c.Int64("part"), path, o, masterKey,
+				c.Bool("preserve"))
+			if err != nil {
+				walkErr = err
+				return false
+			}
+			if same {
+				skipped++
+				return true
+			}
+		}
+		keys = append(keys, *o.Key)
+		paths = append(paths, path)
+		sizes = append(sizes, aws.Int64Value(o.Size))
+		return true
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("%d of %d objects already restored, skipping\n", skipped, skipped+len(keys))
+
+	if c.Bool("dry") {
+		for i, key := range keys {
+			fmt.Printf("downloading s3://%s/%s to %s\n", c.String("bucket"), key, paths[i])
+		}
+		return nil
+	}
+
+	journal, err := syncJournal(c.GlobalString("state_dir"), job.RunRestore, "", keys, paths)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Printf("run %s, journal %s\n", journal.ID, journal.Path)
+
+	transfer := job.Transfer{Engine: engine, Bucket: c.String("bucket"), Options: opts}
+	// the symlinks restored with preserve must not lead the files out of dst
+	var root string
+	if c.Bool("preserve") {
+		root = c.String("dst")
+	}
+	tasks := make([]job.Task, 0, len(keys))
+	var total int64
+	for i, key := range keys {
+		tasks = append(tasks, &job.Download{Transfer: transfer, Key: key, Dst: paths[i], Root: root,
+			Bytes: sizes[i]})
+		total += sizes[i]
+	}
+
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	handleSignals(interrupt, c.Duration("grace"))
+	bar := newProgress(total, len(keys), c.Int("forks"), c.Bool("detail"))
+	pool := job.NewPool(ctx, c.Int("forks"))
+	pool.Retry = retryPolicy(c)
+	pool.Progress = bar
+	pool.Journal = journal
+	start := time.Now()
+	runTasks(pool, tasks)
+	_, err = finishRun(bar, pool, "downloaded", skipped, start, c.String("report"),
+		strings.TrimSuffix(journal.Path, ".jsonl")+"-report.json", nil)
+	if pool.Interrupted() {
+		fmt.Println("run restore again to download the files left")
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRestorePath(t *testing.T) {
+	dst := filepath.Join("restore", "dst")
+	tests := []struct {
+		prefix, key string
+		want        string
+		ok          bool
+	}{
+		{"", "a/b", "a/b", true},
+		{"bk", "bk/a/b", "a/b", true},
+		{"bk/", "bk/a/b", "a/b", true},
+		{"bk/a", "bk/a", "", false},
+		// the prefix is a whole path component of the key
+		{"bk", "bk2/a", "", false},
+		{"bk/a", "bk/ab/c", "", false},
+		{"bk/a", "bk/a/c", "c", true},
+		{"", "../etc/passwd", "", false},
+		{"bk/", "bk/a/../../x", "", false},
+		{"bk/", "bk/a/../b", "b", true},
+	}
+	for _, tt := range tests {
+		got, ok := restorePath(dst, tt.prefix, tt.key)
+		want := ""
+		if tt.want != "" {
+			want = filepath.Join(dst, filepath.FromSlash(tt.want))
+		}
+		if got != want || ok != tt.ok {
+			t.Errorf("restorePath(%q, %q) = %q, %v, want %q, %v", tt.prefix, tt.key, got, ok, want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// filterRule includes or excludes the paths matched by re. Like rsync, a
+// glob with no slash matches the last component of a path, one with a
+// slash the end of the path, and a leading slash anchors it to the base
+// directory of the rule. "**" matches across slashes and a trailing slash
+// only matches directories. A pattern written re:<regex> is a regular
+// expression matched against the path, directories ending with a slash.
+type filterRule struct {
+	include bool
+	dirOnly bool
+	regex   bool
+	re      *regexp.Regexp
+	pattern string
+	// source is where the rule comes from, a flag or an ignore file line.
+	source string
+}
+
+func (r *filterRule) String() string {
+	return fmt.Sprintf("%s %q", r.source, r.pattern)
+}
+
+// match reports whether the rule matches rel, a slash separated path
+// relative to the base directory of the rule.
+func (r *filterRule) match(rel string, isDir bool) bool {
+	if r.regex {
+		if isDir {
+			rel += "/"
+		}
+		return r.re.MatchString(rel)
+	}
+	if r.dirOnly && !isDir {
+		return false
+	}
+	return r.re.MatchString(rel)
+}
+
+func newFilterRule(pattern string, include bool, source string) (*filterRule, error) {
+	if pattern == "" || pattern == "re:" {
+		return nil, fmt.Errorf("empty pattern in %s", source)
+	}
+	r := &filterRule{include: include, pattern: pattern, source: source}
+	var err error
+	if strings.HasPrefix(pattern, "re:") {
+		r.regex = true
+		r.re, err = regexp.Compile(pattern[len("re:"):])
+	} else {
+		glob := pattern
+		if strings.HasSuffix(glob, "/") {
+			r.dirOnly = true
+			glob = strings.TrimRight(glob, "/")
+		}
+		r.re, err = regexp.Compile(globRegexp(glob))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q in %s: %v", pattern, source, err)
+	}
+	return r, nil
+}
+
+// globRegexp translates a glob into the regular expression matching the
+// paths it selects.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	if strings.HasPrefix(glob, "/") {
+		glob = strings.TrimLeft(glob, "/")
+		b.WriteString("^")
+	} else {
+		b.WriteString("(^|/)")
+	}
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				b.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			if j := strings.IndexByte(glob[i+1:], ']'); j >= 0 {
+				class := glob[i+1 : i+1+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += j + 1
+			} else {
+				b.WriteString(`\[`)
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// filterRules are the --include and --exclude rules in the order given.
+type filterRules struct {
+	rules []*filterRule
+}
+
+// ruleFlag is the value of --include or --exclude. Both add to the same
+// list so the order of the rules on the command line is kept.
+type ruleFlag struct {
+	list    *filterRules
+	include bool
+}
+
+func (f *ruleFlag) Set(pattern string) error {
+	source := "--exclude"
+	if f.include {
+		source = "--include"
+	}
+	rule, err := newFilterRule(pattern, f.include, source)
+	if err != nil {
+		return err
+	}
+	f.list.rules = append(f.list.rules, rule)
+	return nil
+}
+
+func (f *ruleFlag) String() string {
+	return ""
+}
+
+// loadIgnoreFile reads the rules of an ignore file: one glob or re:<regex>
+// per line, excluding what it matches unless it starts with "!". As in a
+// gitignore file the last matching line wins, so exceptions come after the
+// rules they make an exception to: the rules are returned last line first.
+// Blank lines and lines starting with "#" are skipped. A missing file has
+// no rules.
+func loadIgnoreFile(file string) ([]*filterRule, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	var rules []*filterRule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		include := strings.HasPrefix(line, "!")
+		rule, err := newFilterRule(strings.TrimPrefix(line, "!"), include, fmt.Sprintf("%s:%d", file, n))
+		if err != nil {
+			return nil, err
+		}
+		rules = append([]*filterRule{rule}, rules...)
+	}
+	return rules, errors.WithStack(scanner.Err())
+}
+
+// pathFilter decides which paths under root are synced. The rules given on
+// the command line are tried first, then the ones of the ignore file of
+// the directory of a path and of its parents up to root, the closest
+// first, each relative to its directory. The first rule matching a path
+// decides, the last matching line within an ignore file, and a path no
+// rule matches is included. An excluded directory is
+// not walked, whatever the rules say about its content.
+type pathFilter struct {
+	root       string
+	rules      []*filterRule
+	ignoreFile string
+	dirs       map[string][]*filterRule
+}
+
+func newPathFilter(root string, rules []*filterRule, ignoreFile string) *pathFilter {
+	return &pathFilter{root: root, rules: rules, ignoreFile: ignoreFile, dirs: make(map[string][]*filterRule)}
+}
+
+// dirRules returns the rules of the ignore file of dir, relative to root.
+func (f *pathFilter) dirRules(dir string) ([]*filterRule, error) {
+	if f.ignoreFile == "" {
+		return nil, nil
+	}
+	rules, ok := f.dirs[dir]
+	if !ok {
+		var err error
+		if rules, err = loadIgnoreFile(filepath.Join(f.root, filepath.FromSlash(dir), f.ignoreFile)); err != nil {
+			return nil, err
+		}
+		f.dirs[dir] = rules
+	}
+	return rules, nil
+}
+
+// match returns whether rel, a slash separated path relative to root, is
+// included and the rule deciding it, nil when none matched. The parents of
+// rel are not checked.
+func (f *pathFilter) match(rel string, isDir bool) (bool, *filterRule, error) {
+	for _, r := range f.rules {
+		if r.match(rel, isDir) {
+			return r.include, r, nil
+		}
+	}
+	dir := rel
+	for dir != "." {
+		dir = path.Dir(dir)
+		rules, err := f.dirRules(dir)
+		if err != nil {
+			return false, nil, err
+		}
+		sub := rel
+		if dir != "." {
+			sub = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, r := range rules {
+			if r.match(sub, isDir) {
+				return r.include, r, nil
+			}
+		}
+	}
+	return true, nil, nil
+}
+
+// excluded reports whether the file rel, a slash separated path relative
+// to root, or one of its parent directories is excluded.
+func (f *pathFilter) excluded(rel string) (bool, error) {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		include, _, err := f.match(strings.Join(parts[:i+1], "/"), i < len(parts)-1)
+		if err != nil || !include {
+			return !include, err
+		}
+	}
+	return false, nil
+}
+
+// relPath returns p relative to root, slash separated, and whether p is
+// under root at all.
+func (f *pathFilter) relPath(p string) (string, bool, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	root, err := filepath.Abs(f.root)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false, nil
+	}
+	return filepath.ToSlash(rel), true, nil
+}
+
+// walkPath returns p as the walk of root names it, the path --filter is
+// matched against.
+func (f *pathFilter) walkPath(p string) (string, error) {
+	rel, under, err := f.relPath(p)
+	if err != nil || !under || rel == "." {
+		return filepath.Clean(p), err
+	}
+	return filepath.Join(f.root, filepath.FromSlash(rel)), nil
+}
+
+// explain tells whether the file or directory p is synced and why.
+func (f *pathFilter) explain(p string) (bool, string, error) {
+	rel, under, err := f.relPath(p)
+	if err != nil {
+		return false, "", err
+	}
+	if !under {
+		return false, fmt.Sprintf("%s: not under %s", p, f.root), nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false, "", errors.WithStack(err)
+	}
+	if rel == "." {
+		return true, fmt.Sprintf("%s: the source directory, always walked", p), nil
+	}
+	fi, err := os.Stat(abs)
+	isDir := err == nil && fi.IsDir()
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		sub := strings.Join(parts[:i+1], "/")
+		last := i == len(parts)-1
+		include, rule, err := f.match(sub, isDir || !last)
+		if err != nil {
+			return false, "", err
+		}
+		if !include {
+			if last {
+				return false, fmt.Sprintf("%s: excluded by %s", p, rule), nil
+			}
+			return false, fmt.Sprintf("%s: excluded, its directory %s is excluded by %s", p, sub, rule), nil
+		}
+		if last && rule != nil {
+			return true, fmt.Sprintf("%s: included by %s", p, rule), nil
+		}
+	}
+	return true, fmt.Sprintf("%s: included, no rule matches", p), nil
+}
+
+// explainPaths prints why each of paths is synced or not, regex being the
+// --filter and attrs the attributes the files must also match.
+func explainPaths(filter *pathFilter, attrs *attrFilter, regex string, paths []string) error {
+	var filterRe *regexp.Regexp
+	if regex != "" {
+		var err error
+		if filterRe, err = regexp.Compile(regex); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, p := range paths {
+		include, why, err := filter.explain(p)
+		if err != nil {
+			return err
+		}
+		walked, err := filter.walkPath(p)
+		if err != nil {
+			return err
+		}
+		if include && filterRe != nil && !filterRe.MatchString(walked) {
+			include = false
+			why = fmt.Sprintf("%s: excluded, no match for --filter %q", p, regex)
+		}
+		if fi, err := os.Lstat(p); include && err == nil && !fi.IsDir() {
+			if ok, reason := attrs.match(p, fi); !ok {
+				why = fmt.Sprintf("%s: excluded, %s", p, reason)
+			}
+		}
+		fmt.Println(why)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilterRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "a.log", false, true},
+		{"*.log", "dir/a.log", false, true},
+		{"*.log", "a.log.gz", false, false},
+		{"a/*.log", "a/b.log", false, true},
+		{"a/*.log", "x/a/b.log", false, true},
+		{"a/*.log", "a/b/c.log", false, false},
+		{"/a/*.log", "x/a/b.log", false, false},
+		{"/a/*.log", "a/b.log", false, true},
+		{"a/**/c", "a/c", false, true},
+		{"a/**/c", "a/b/d/c", false, true},
+		{"a/**", "a/b/c", false, true},
+		{"?.txt", "a.txt", false, true},
+		{"?.txt", "ab.txt", false, false},
+		{"[ab].txt", "b.txt", false, true},
+		{"[!ab].txt", "b.txt", false, false},
+		{"[!ab].txt", "c.txt", false, true},
+		{"a[b", "a[b", false, true},
+		{"a.b", "axb", false, false},
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+		{"re:\\.tmp$", "x/y.tmp", false, true},
+		{"re:^build/$", "build", true, true},
+		{"re:^build/$", "build", false, false},
+	}
+	for _, tt := range tests {
+		rule, err := newFilterRule(tt.pattern, false, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rule.match(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("%q matching %s (dir %v) = %v, want %v, regexp %s", tt.pattern, tt.rel, tt.isDir, got,
+				tt.want, rule.re)
+		}
+	}
+	for _, pattern := range []string{"", "re:", "re:("} {
+		if _, err := newFilterRule(pattern, false, "test"); err == nil {
+			t.Errorf("invalid pattern %q accepted", pattern)
+		}
+	}
+}
+
+// writeTree creates files under dir, the content of each being its value.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testRules(t *testing.T, flags ...string) []*filterRule {
+	list := &filterRules{}
+	for _, flag := range flags {
+		f := &ruleFlag{list: list, include: strings.HasPrefix(flag, "+")}
+		if err := f.Set(flag[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return list.rules
+}
+
+func TestPathFilterMatch(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".snowballignore":         "*.log\n# comment\n\n!keep.log\n/top.tmp\n",
+		"a/.snowballignore":       "!*.log\ndata/\n",
+		"a/b/.snowballignore":     "*.log\n!w.log\n",
+		"a/b/c/.snowballignore":   "re:^y\\.txt$\n",
+		"other/.snowballignore":   "!*.tmp\n",
+		"a/b/c/y.txt":             "",
+		"a/b/c/z.txt":             "",
+		"a/b/x.log":               "",
+		"a/b/w.log":               "",
+		"a/keep.log":              "",
+		"a/data/f":                "",
+		"other/top.tmp":           "",
+		"top.tmp":                 "",
+		"keep.log":                "",
+		"drop.log":                "",
+		"flags/secret.txt":        "",
+		"flags/public/secret.txt": "",
+	})
+	filter := newPathFilter(root, testRules(t, "+flags/public/**", "-secret.txt"), ".snowballignore")
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"drop.log", false, false},
+		{"keep.log", false, true},
+		{"top.tmp", false, false},
+		// the rules of a file are relative to its directory
+		{"other/top.tmp", false, true},
+		{"a/data", true, false},
+		{"a/data", false, true},
+		// the closest ignore file decides first, its last matching line
+		{"a/b/w.log", false, true},
+		{"a/b/x.log", false, false},
+		{"a/keep.log", false, true},
+		{"a/b/c/y.txt", false, false},
+		{"a/b/c/z.txt", false, true},
+		// the flags are tried before any ignore file, in order
+		{"flags/secret.txt", false, false},
+		{"flags/public/secret.txt", false, true},
+	}
+	for _, tt := range tests {
+		got, rule, err := filter.match(tt.rel, tt.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("match(%s) = %v by %v, want %v", tt.rel, got, rule, tt.want)
+		}
+	}
+
+	fullPath, _, err := scanDir(root, "", "", filter, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range fullPath {
+		if strings.Contains(p, filepath.Join("a", "data")) {
+			t.Errorf("%s walked in an excluded directory", p)
+		}
+	}
+}
+
+func TestPathFilterNoIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{".snowballignore": "*.log\n", "a.log": ""})
+	filter := newPathFilter(root, nil, "")
+	if include, _, err := filter.match("a.log", false); err != nil || !include {
+		t.Errorf("match with ignore files disabled = %v, %v", include, err)
+	}
+}
+
+func TestPathFilterWalkPath(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a/b.txt": ""})
+	src := root + string(filepath.Separator) + "." + string(filepath.Separator)
+	filter := newPathFilter(src, nil, "")
+	tests := []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(root, "a", "b.txt"), filepath.Join(src, "a", "b.txt")},
+		{root + "/a/../a/./b.txt", filepath.Join(src, "a", "b.txt")},
+		{"/elsewhere//x", "/elsewhere/x"},
+	}
+	for _, tt := range tests {
+		got, err := filter.walkPath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("walkPath(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+	walked, _, err := scanDir(src, "", "", nil, nil, false, nil)
+	if err != nil || len(walked) != 1 || walked[0] != tests[0].want {
+		t.Errorf("scanDir walked %q, %v, want %s", walked, err, tests[0].want)
+	}
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+)
+
+// handleSignals calls interrupt on SIGINT or SIGTERM, so no new file is
+// started, and gives the transfers in flight grace to finish before they
+// are canceled. A second signal exits at once, the journal holding every
+// state change already.
+func handleSignals(interrupt context.CancelFunc, grace time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("%s received, finishing the transfers in flight for up to %s, again to exit now\n", sig, grace)
+		interrupt()
+		timer := time.AfterFunc(grace, func() {
+			log.Println("grace period over, canceling the transfers in flight")
+			cloud.Cancel()
+		})
+		sig = <-signals
+		timer.Stop()
+		log.Printf("%s received, exiting now\n", sig)
+		os.Exit(exitInterrupted)
+	}()
+}
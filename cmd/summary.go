@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// Exit codes of the runs of sync and restore. Success is 0.
+const (
+	exitFatal       = 1
+	exitPartial     = 2
+	exitInterrupted = 130
+)
+
+// deleteResult is the outcome of the deletions of a run.
+type deleteResult struct {
+	n        int
+	failures []job.DeleteFailure
+}
+
+// finishRun closes the journal and prints the summary of the run of pool,
+// verb naming what was done to the files, with deleted when the run also
+// deleted objects. The summary is written as JSON to report, or to
+// failedReport when files failed and report is empty. The error returned
+// carries the exit code of the outcome.
+func finishRun(bar *progress, pool *job.Pool, verb string, skipped int, start time.Time,
+	report, failedReport string, deleted *deleteResult) (*job.Summary, error) {
+	if err := pool.Journal.Close(); err != nil {
+		log.Println(err)
+	}
+	summary := pool.Journal.Summary(skipped, time.Since(start), pool.Err())
+	if deleted != nil {
+		summary.Deleted, summary.DeleteFailures = deleted.n, deleted.failures
+	}
+	bar.finish("Finished: " + summary.Text(verb))
+	if report == "" && (summary.Failed > 0 || len(summary.DeleteFailures) > 0) {
+		report = failedReport
+	}
+	if report != "" {
+		if err := summary.WriteJSON(report); err != nil {
+			log.Println(err)
+		} else {
+			fmt.Printf("report written to %s\n", report)
+		}
+	}
+	if pool.Interrupted() {
+		return summary, cli.NewExitError(fmt.Sprintf("run interrupted, %d files left", summary.Left),
+			exitInterrupted)
+	}
+	if err := pool.Aborted(); err != nil {
+		return summary, cli.NewExitError(fmt.Sprintf("run stopped by %s error: %v", cloud.Classify(err), err),
+			exitFatal)
+	}
+	switch {
+	case summary.Failed > 0 && len(summary.DeleteFailures) > 0:
+		return summary, cli.NewExitError(fmt.Sprintf("%d files failed, %d objects not deleted", summary.Failed,
+			len(summary.DeleteFailures)), exitPartial)
+	case summary.Failed > 0:
+		return summary, cli.NewExitError(fmt.Sprintf("%d files failed", summary.Failed), exitPartial)
+	case len(summary.DeleteFailures) > 0:
+		return summary, cli.NewExitError(fmt.Sprintf("%d objects not deleted", len(summary.DeleteFailures)),
+			exitPartial)
+	}
+	return summary, nil
+}
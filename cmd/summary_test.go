@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iandri/snowball/job"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestFinishRunDeletions(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted *deleteResult
+		want    int
+	}{
+		{"no deletions", nil, 0},
+		{"deleted", &deleteResult{n: 2}, 0},
+		{"not deleted", &deleteResult{n: 1, failures: []job.DeleteFailure{{Key: "a", Error: "AccessDenied"}}},
+			exitPartial},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		journal, err := job.NewJournal(dir, job.RunSync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := job.NewPool(context.Background(), 1)
+		pool.Journal = journal
+		pool.Close()
+		report := filepath.Join(dir, "report.json")
+		summary, err := finishRun(newProgress(0, 0, 1, false), pool, "uploaded", 0, time.Now(), report, "",
+			tt.deleted)
+		code := 0
+		if err != nil {
+			code = err.(cli.ExitCoder).ExitCode()
+		}
+		if code != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, code, tt.want)
+		}
+		data, err := ioutil.ReadFile(report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var written job.Summary
+		if err := json.Unmarshal(data, &written); err != nil {
+			t.Fatal(err)
+		}
+		if tt.deleted != nil && (written.Deleted != tt.deleted.n ||
+			len(written.DeleteFailures) != len(tt.deleted.failures)) {
+			t.Errorf("%s: report of %d deleted, %v not deleted", tt.name, written.Deleted, written.DeleteFailures)
+		}
+		if summary.Deleted != written.Deleted {
+			t.Errorf("%s: summary of %d deleted, report of %d", tt.name, summary.Deleted, written.Deleted)
+		}
+	}
+}
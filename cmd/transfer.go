@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/iandri/snowball/cloud"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// engine makes the transfers of the session opened by initialize.
+var engine *cloud.Engine
+
+// transferOptions returns the options of the transfers of c, uploads being
+// encoded as set by enc.
+func transferOptions(c *cli.Context, enc cloud.Encoding) (cloud.Options, error) {
+	opts := cloud.Options{
+		PartSize:     c.Int64("part"),
+		Concurrency:  c.Int("threads"),
+		StorageClass: c.String("storage-class"),
+		Encoding:     enc,
+		StateDir:     c.GlobalString("state_dir"),
+		Preserve:     c.Bool("preserve"),
+		Xattrs:       c.Bool("xattrs"),
+		Symlinks:     c.Bool("symlinks"),
+	}
+	if (opts.Xattrs || opts.Symlinks) && !opts.Preserve {
+		return opts, fmt.Errorf("xattrs and symlinks need preserve")
+	}
+	var err error
+	if opts.Checksum, err = cloud.ParseChecksumMode(c.String("checksum")); err != nil {
+		return opts, err
+	}
+	for _, kv := range c.StringSlice("metadata") {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return opts, fmt.Errorf("invalid metadata %q, expected key=value", kv)
+		}
+		if opts.Metadata == nil {
+			opts.Metadata = make(map[string]*string)
+		}
+		opts.Metadata[kv[:i]] = aws.String(kv[i+1:])
+	}
+	return opts, nil
+}
@@ -0,0 +1,103 @@
+package job
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/iandri/snowball/cloud"
+)
+
+// BatchKeyPrefix starts the name of every tar batch object, stored under
+// the destination prefix of its run.
+const BatchKeyPrefix = "snowball-batch-"
+
+// IsBatchKey reports whether key is the one of a tar batch object.
+func IsBatchKey(key string) bool {
+	return strings.HasPrefix(path.Base(key), BatchKeyPrefix) && strings.HasSuffix(key, ".tar")
+}
+
+// Batch is a group of small files uploaded as a single tar object that the
+// device extracts on import.
+type Batch struct {
+	Key      string
+	FullPath []string
+	Files    []string
+	Sizes    []int64
+	Size     int64
+}
+
+// batchKey returns the key under prefix of the batch number n of the run
+// name.
+func batchKey(prefix, name string, n int) string {
+	return fmt.Sprintf("%s%s%s-%05d.tar", prefix, BatchKeyPrefix, name, n)
+}
+
+// batchNumber returns the number of the batch key, 0 when it is not one.
+func batchNumber(key string) int {
+	if !IsBatchKey(key) {
+		return 0
+	}
+	key = strings.TrimSuffix(key, ".tar")
+	n, err := strconv.Atoi(key[strings.LastIndex(key, "-")+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// MakeBatches splits the files smaller than under bytes into batches of at
+// most maxBytes and maxCount files, stored under prefix and numbered from
+// first so that a resumed run never overwrites the batches of an earlier
+// attempt. The other files, and the directories, are returned unchanged.
+func MakeBatches(fullPath, files []string, under, maxBytes int64, maxCount int, prefix, name string,
+	first int) ([]string, []string, []*Batch, error) {
+	var singlesFull, singles []string
+	var batches []*Batch
+	var current *Batch
+	for i, file := range files {
+		fi, err := os.Stat(fullPath[i])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if fi.IsDir() || fi.Size() >= under {
+			singlesFull = append(singlesFull, fullPath[i])
+			singles = append(singles, file)
+			continue
+		}
+		if current == nil || len(current.Files) >= maxCount || current.Size+fi.Size() > maxBytes {
+			current = &Batch{Key: batchKey(prefix, name, first+len(batches))}
+			batches = append(batches, current)
+		}
+		current.FullPath = append(current.FullPath, fullPath[i])
+		current.Files = append(current.Files, file)
+		current.Sizes = append(current.Sizes, fi.Size())
+		current.Size += fi.Size()
+	}
+	return singlesFull, singles, batches, nil
+}
+
+// BatchUpload uploads Batch as a single auto-extracting tar object.
+type BatchUpload struct {
+	Transfer
+	Batch *Batch
+}
+
+func (t *BatchUpload) Name() string {
+	return t.Batch.Key
+}
+
+func (t *BatchUpload) Srcs() []string {
+	return t.Batch.FullPath
+}
+
+func (t *BatchUpload) Size() int64 {
+	return t.Batch.Size
+}
+
+func (t *BatchUpload) Run(progress cloud.Progress) ([]int64, error) {
+	_, err := t.Engine.UploadBatch(t.Bucket, t.Batch.FullPath, t.Batch.Files, t.Batch.Key, t.options(progress))
+	return t.Batch.Sizes, err
+}
@@ -0,0 +1,117 @@
+package job
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBatchKey(t *testing.T) {
+	tests := []struct {
+		key    string
+		batch  bool
+		number int
+	}{
+		{batchKey("bk/", "run", 7), true, 7},
+		{batchKey("", "run-2", 12), true, 12},
+		{"bk/snowball-batch-run-00003.tar.gz", false, 0},
+		{"bk/data/a.tar", false, 0},
+		{"snowball-batch-run-x.tar", true, 0},
+	}
+	for _, tt := range tests {
+		if got := IsBatchKey(tt.key); got != tt.batch {
+			t.Errorf("IsBatchKey(%s) = %v, want %v", tt.key, got, tt.batch)
+		}
+		if got := batchNumber(tt.key); got != tt.number {
+			t.Errorf("batchNumber(%s) = %d, want %d", tt.key, got, tt.number)
+		}
+	}
+}
+
+func TestMakeBatches(t *testing.T) {
+	dir := t.TempDir()
+	var fullPath, files []string
+	for _, f := range []struct {
+		name string
+		size int
+	}{{"a", 10}, {"b", 10}, {"big", 100}, {"c", 10}} {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, make([]byte, f.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fullPath = append(fullPath, path)
+		files = append(files, "bk/"+f.name)
+	}
+	singlesFull, singles, batches, err := MakeBatches(fullPath, files, 50, 1000, 2, "bk/", "run", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(singles, []string{"bk/big"}) || singlesFull[0] != fullPath[2] {
+		t.Errorf("singles %q", singles)
+	}
+	if len(batches) != 2 {
+		t.Fatalf("%d batches, want 2", len(batches))
+	}
+	for i, want := range []struct {
+		key   string
+		files []string
+	}{
+		{"bk/snowball-batch-run-00003.tar", []string{"bk/a", "bk/b"}},
+		{"bk/snowball-batch-run-00004.tar", []string{"bk/c"}},
+	} {
+		if batches[i].Key != want.key || !reflect.DeepEqual(batches[i].Files, want.files) {
+			t.Errorf("batch %d = %s holding %q, want %s holding %q", i, batches[i].Key, batches[i].Files,
+				want.key, want.files)
+		}
+	}
+}
+
+func TestBatchedFiles(t *testing.T) {
+	dir := t.TempDir()
+	if batched, err := BatchedFiles(dir); err != nil || len(batched) != 0 {
+		t.Fatalf("BatchedFiles with no runs = %v, %v", batched, err)
+	}
+	runs := []struct {
+		kind    string
+		batched map[string]string
+		failed  []string
+	}{
+		{RunSync, map[string]string{"/a": "bk/snowball-batch-1-00001.tar", "/b": "bk/snowball-batch-1-00001.tar"},
+			nil},
+		// a later run batching a again, failing on c
+		{RunSync, map[string]string{"/a": "bk/snowball-batch-2-00001.tar", "/c": "bk/snowball-batch-2-00001.tar"},
+			[]string{"/c"}},
+		{RunRestore, map[string]string{"/d": "bk/snowball-batch-3-00001.tar"}, nil},
+	}
+	for _, run := range runs {
+		j, err := NewJournal(dir, run.kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for src, batch := range run.batched {
+			j.Add(src, "bk"+src)
+			j.Batched(src, batch)
+			j.Done(src, 10)
+		}
+		for _, src := range run.failed {
+			j.Failed(src, errInterrupted)
+		}
+		j.Close()
+	}
+	batched, err := BatchedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"bk/a": "bk/snowball-batch-2-00001.tar", "bk/b": "bk/snowball-batch-1-00001.tar"}
+	got := make(map[string]string)
+	for key, b := range batched {
+		got[key] = b.Batch
+		if b.Size != 10 || b.Key != key || b.Time.IsZero() {
+			t.Errorf("%s batched as %+v", key, b)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("BatchedFiles = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package job
+
+import (
+	"github.com/iandri/snowball/cloud"
+)
+
+// Copy copies the object SrcKey of SrcBucket, of Bytes bytes, to the key
+// Dst of the bucket of the transfer, on the device.
+type Copy struct {
+	Transfer
+	SrcBucket string
+	SrcKey    string
+	Dst       string
+	Bytes     int64
+}
+
+func (t *Copy) Name() string {
+	return t.SrcKey
+}
+
+func (t *Copy) Srcs() []string {
+	return []string{t.SrcKey}
+}
+
+func (t *Copy) Size() int64 {
+	return t.Bytes
+}
+
+func (t *Copy) Run(progress cloud.Progress) ([]int64, error) {
+	result, err := t.Engine.Copy(t.SrcBucket, t.SrcKey, t.Bucket, t.Dst, t.options(progress))
+	return []int64{result.Size}, err
+}
@@ -0,0 +1,47 @@
+package job
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/iandri/snowball/cloud"
+)
+
+// Delete deletes Keys, at most cloud.MaxDeleteKeys for a single request.
+// Output holds what the device answered to the last attempt.
+type Delete struct {
+	Transfer
+	Keys   []string
+	Output *s3.DeleteObjectsOutput
+}
+
+func (t *Delete) Name() string {
+	return fmt.Sprintf("%d keys from %s", len(t.Keys), t.Keys[0])
+}
+
+func (t *Delete) Srcs() []string {
+	return t.Keys
+}
+
+func (t *Delete) Size() int64 {
+	return 0
+}
+
+func (t *Delete) Run(progress cloud.Progress) ([]int64, error) {
+	output, err := cloud.DeleteObjects(t.Engine.S3, t.Bucket, t.Keys, "")
+	t.Output = output
+	return make([]int64, len(t.Keys)), err
+}
+
+// DeleteTasks splits keys into Delete tasks of cloud.MaxDeleteKeys keys.
+func DeleteTasks(tr Transfer, keys []string) []Task {
+	var tasks []Task
+	for start := 0; start < len(keys); start += cloud.MaxDeleteKeys {
+		end := start + cloud.MaxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		tasks = append(tasks, &Delete{Transfer: tr, Keys: keys[start:end]})
+	}
+	return tasks
+}
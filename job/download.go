@@ -0,0 +1,78 @@
+package job
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/iandri/snowball/cloud"
+	"github.com/pkg/errors"
+)
+
+// Download restores the object Key, of Bytes bytes, to the local file Dst.
+// The journal records the attempts the same way as an upload, under the
+// key. When Root is set, Dst is not written through a symlink between Root
+// and it, one restored earlier could point out of Root.
+type Download struct {
+	Transfer
+	Key   string
+	Dst   string
+	Root  string
+	Bytes int64
+}
+
+func (t *Download) Name() string {
+	return t.Key
+}
+
+func (t *Download) Srcs() []string {
+	return []string{t.Key}
+}
+
+func (t *Download) Size() int64 {
+	return t.Bytes
+}
+
+func (t *Download) Run(progress cloud.Progress) ([]int64, error) {
+	if t.Root != "" {
+		link, err := symlinkParent(t.Root, t.Dst)
+		if err != nil {
+			return nil, err
+		}
+		if link != "" {
+			return nil, fmt.Errorf("not writing %s through the symlink %s", t.Dst, link)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(t.Dst), 0755); err != nil {
+		return nil, err
+	}
+	result, err := t.Engine.Download(t.Bucket, t.Key, t.Dst, t.options(progress))
+	return []int64{result.Size}, err
+}
+
+// symlinkParent returns the first directory between root and path that is
+// a symlink, empty when there is none.
+func symlinkParent(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, filepath.Dir(path))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if rel == "." {
+		return "", nil
+	}
+	dir := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", errors.WithStack(err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return dir, nil
+		}
+	}
+	return "", nil
+}
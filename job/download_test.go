@@ -0,0 +1,56 @@
+package job
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymlinkParent(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "top")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"f", ""},
+		{"a/b/f", ""},
+		{"a/missing/f", ""},
+		// a symlink as the file itself is replaced, not written through
+		{"a/link", ""},
+		{"a/link/f", "a/link"},
+		{"a/link/x/f", "a/link"},
+		{"top/f", "top"},
+	}
+	for _, tt := range tests {
+		got, err := symlinkParent(root, filepath.Join(root, filepath.FromSlash(tt.path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ""
+		if tt.want != "" {
+			want = filepath.Join(root, filepath.FromSlash(tt.want))
+		}
+		if got != want {
+			t.Errorf("symlinkParent(%s) = %q, want %q", tt.path, got, want)
+		}
+	}
+
+	task := &Download{Key: "a/link/f", Dst: filepath.Join(root, "a", "link", "f"), Root: root}
+	if _, err := task.Run(nil); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("download through a symlink gave %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "f")); !os.IsNotExist(err) {
+		t.Errorf("file written out of the root: %v", err)
+	}
+}
@@ -1,113 +1,153 @@
 package job
 
 import (
-	"fmt"
-	"log"
-
+	"context"
 	"sync"
 
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/iandri/snowball/cloud"
-	"gopkg.in/cheggaaa/pb.v1"
 )
 
-type WorkRequest struct {
-	S3SVC    *s3.S3
-	Bucket   string
-	PartSize int64
-	Threads  int
-	Src      string
-	Dst      string
-	WG       *sync.WaitGroup
-	PB       *pb.ProgressBar
+// Task is a transfer run by the workers of a Pool.
+type Task interface {
+	// Name is what the task is shown as in the progress.
+	Name() string
+	// Srcs are the files or keys the task moves, its journal entries.
+	Srcs() []string
+	// Size is the number of bytes the task moves.
+	Size() int64
+	// Run makes one attempt at the task, reporting the bytes moved to
+	// progress, and returns the bytes moved for each src.
+	Run(progress cloud.Progress) ([]int64, error)
 }
 
-type Worker struct {
-	ID          int
-	Work        chan WorkRequest
-	WorkerQueue chan chan WorkRequest
-	QuitChan    chan bool
+// Transfer is the engine, the bucket and the options shared by the tasks
+// of a run.
+type Transfer struct {
+	Engine  *cloud.Engine
+	Bucket  string
+	Options cloud.Options
 }
 
-var WorkerQueue chan chan WorkRequest
+// options returns the options of an attempt reporting to progress.
+func (t Transfer) options(progress cloud.Progress) cloud.Options {
+	opts := t.Options
+	opts.Hooks.Progress = progress
+	return opts
+}
 
-// A buffered channel that we can send work requests on.
-var WorkQueue = make(chan WorkRequest, 100)
+// Result is the outcome of a Task.
+type Result struct {
+	Task     Task
+	Worker   int
+	Sizes    []int64
+	Attempts int
+	Err      error
+}
 
-func StartDispather(nWorkers int) {
-	// First, initialize the channel
-	WorkerQueue = make(chan chan WorkRequest, nWorkers)
+// Pool runs tasks on a fixed number of workers until its context is done:
+// the tasks not started yet are then dropped, and the ones in flight are
+// let finish without being tried again.
+type Pool struct {
+	// Retry is the policy of every task, Progress follows their bytes and
+	// Journal, when set, records their attempts. They are set before the
+	// first Submit.
+	Retry    RetryPolicy
+	Progress Monitor
+	Journal  *Journal
+
+	ctx     context.Context
+	tasks   chan Task
+	results chan Result
+	wg      sync.WaitGroup
+
+	mu    sync.Mutex
+	abort error
+}
 
-	// Now create all of our workers.
-	for i := 0; i < nWorkers; i++ {
-		//fmt.Println("Starting worker", i+1)
-		worker := NewWorker(i+1, WorkerQueue)
-		worker.Start()
+// NewPool starts a pool of workers running tasks until ctx is done.
+func NewPool(ctx context.Context, workers int) *Pool {
+	p := &Pool{
+		Retry:    DefaultRetry,
+		Progress: noMonitor{},
+		ctx:      ctx,
+		tasks:    make(chan Task),
+		results:  make(chan Result, workers),
+	}
+	p.wg.Add(workers)
+	for i := 1; i <= workers; i++ {
+		go p.work(i)
 	}
-
 	go func() {
-		for {
-			select {
-			case work := <-WorkQueue:
-				//fmt.Println("Received work request.")
-				go func() {
-					worker := <-WorkerQueue
-					//fmt.Println("Dispatching work request")
-					worker <- work
-				}()
-			}
-		}
+		p.wg.Wait()
+		close(p.results)
 	}()
+	return p
 }
 
-func NewWorker(id int, workerQueue chan chan WorkRequest) Worker {
-	worker := Worker{
-		ID:          id,
-		Work:        make(chan WorkRequest),
-		WorkerQueue: workerQueue,
-		QuitChan:    make(chan bool),
+func (p *Pool) work(id int) {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		// no task starts while the transfers are paused
+		cloud.Bandwidth.Hold()
+		p.results <- p.run(id, task)
 	}
-	return worker
 }
 
-func (w *Worker) Start() {
-	go func() {
-		for {
-			w.WorkerQueue <- w.Work
-
-			select {
-			case work := <-w.Work:
-				//fmt.Printf("worker%d: Received work request, processing file %s\n",
-				//	w.ID, work.Src)
-
-				//time.Sleep(work.Delay)
-				_, err := cloud.MultiUploadObject(work.PB, work.WG, work.S3SVC, work.Bucket,
-					work.PartSize, work.Threads, work.Src, work.Dst)
-				if err != nil {
-					log.Println(err)
-				}
-
-				//fmt.Printf("worker%d: Hello, %s!\n", w.ID, work.Name)
-
-			case <-w.QuitChan:
-				// We have been asked to stop.
-				fmt.Printf("worker%d stopping\n", w.ID)
-			}
-		}
-	}()
+// Submit queues task for the next free worker. Once the context of p is
+// done, task is dropped and false returned.
+func (p *Pool) Submit(task Task) bool {
+	if p.Interrupted() {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
 }
 
-// Stop the worker.
-func (w *Worker) Stop() {
-	go func() {
-		w.QuitChan <- true
-	}()
+// Close tells p no more task is coming. The workers stop and Results is
+// closed once the tasks submitted are done.
+func (p *Pool) Close() {
+	close(p.tasks)
 }
 
-func Collector(pb *pb.ProgressBar, wg *sync.WaitGroup, s3SVC *s3.S3, bucket string,
-	partSize int64, threads int, src, dst string) {
-	work := WorkRequest{PB: pb, WG: wg, S3SVC: s3SVC, Bucket: bucket, PartSize: partSize,
-		Threads: threads, Src: src, Dst: dst}
-	WorkQueue <- work
-	//fmt.Println("Work request queued")
+// Results returns the outcome of every task submitted, dropped ones
+// included. It must be drained for the workers to go on.
+func (p *Pool) Results() <-chan Result {
+	return p.results
+}
+
+// Interrupted reports whether the context of p is done.
+func (p *Pool) Interrupted() bool {
+	return p.ctx.Err() != nil
+}
+
+// Aborted returns the fatal error that stopped the run of p, if any. The
+// tasks still queued fail with it without being tried.
+func (p *Pool) Aborted() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.abort
+}
+
+func (p *Pool) setAborted(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.abort == nil {
+		p.abort = err
+	}
+}
+
+// Err returns why the run of p stopped early: the fatal error of a task,
+// or the interruption of its context.
+func (p *Pool) Err() error {
+	if err := p.Aborted(); err != nil {
+		return err
+	}
+	if p.Interrupted() {
+		return errInterrupted
+	}
+	return nil
 }
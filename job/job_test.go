@@ -0,0 +1,233 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/iandri/snowball/cloud"
+)
+
+// fakeTask fails its attempts with errs in turn, then succeeds. When
+// started is set, every attempt is announced on it and waits for release.
+type fakeTask struct {
+	name     string
+	size     int64
+	errs     []error
+	attempts int32
+	started  chan string
+	release  chan struct{}
+}
+
+func (t *fakeTask) Name() string   { return t.name }
+func (t *fakeTask) Srcs() []string { return []string{t.name} }
+func (t *fakeTask) Size() int64    { return t.size }
+func (t *fakeTask) tries() int     { return int(atomic.LoadInt32(&t.attempts)) }
+
+func (t *fakeTask) Run(progress cloud.Progress) ([]int64, error) {
+	n := atomic.AddInt32(&t.attempts, 1)
+	if t.started != nil {
+		t.started <- t.name
+		<-t.release
+	}
+	if int(n) <= len(t.errs) {
+		return nil, t.errs[n-1]
+	}
+	progress(t.size)
+	return []int64{t.size}, nil
+}
+
+var fastRetry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+func results(p *Pool) map[string]Result {
+	all := make(map[string]Result)
+	for res := range p.Results() {
+		all[res.Task.Name()] = res
+	}
+	return all
+}
+
+func TestPoolResults(t *testing.T) {
+	p := NewPool(context.Background(), 3)
+	names := []string{"a", "b", "c", "d", "e", "f", "g"}
+	go func() {
+		for i, name := range names {
+			if !p.Submit(&fakeTask{name: name, size: int64(i)}) {
+				t.Errorf("task %s dropped", name)
+			}
+		}
+		p.Close()
+	}()
+	all := results(p)
+	if len(all) != len(names) {
+		t.Fatalf("%d results, want %d", len(all), len(names))
+	}
+	for i, name := range names {
+		res := all[name]
+		if res.Err != nil || res.Attempts != 1 || len(res.Sizes) != 1 || res.Sizes[0] != int64(i) {
+			t.Errorf("result of %s = %+v", name, res)
+		}
+		if res.Worker < 1 || res.Worker > 3 {
+			t.Errorf("%s ran on worker %d", name, res.Worker)
+		}
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Err = %v", err)
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	throttled := awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "")
+	checksum := &cloud.ChecksumError{Key: "a", Local: "1", Remote: "2"}
+	other := errors.New("no such file")
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{"success", nil, 1, nil},
+		{"transient then success", []error{throttled, checksum}, 3, nil},
+		{"transient every time", []error{throttled, throttled, throttled, throttled}, 3, throttled},
+		{"not transient", []error{other}, 1, other},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPool(context.Background(), 1)
+			p.Retry = fastRetry
+			task := &fakeTask{name: tt.name, errs: tt.errs}
+			go func() {
+				p.Submit(task)
+				p.Close()
+			}()
+			res := results(p)[tt.name]
+			if res.Attempts != tt.attempts || task.tries() != tt.attempts {
+				t.Errorf("%d attempts, %d run, want %d", res.Attempts, task.tries(), tt.attempts)
+			}
+			if res.Err != tt.err {
+				t.Errorf("Err = %v, want %v", res.Err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPoolFatal(t *testing.T) {
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), 403, "")
+	p := NewPool(context.Background(), 1)
+	p.Retry = fastRetry
+	fatal := &fakeTask{name: "fatal", errs: []error{denied}}
+	next := &fakeTask{name: "next"}
+	go func() {
+		p.Submit(fatal)
+		p.Submit(next)
+		p.Close()
+	}()
+	all := results(p)
+	if res := all["fatal"]; res.Attempts != 1 || res.Err != denied {
+		t.Errorf("fatal task result = %+v", res)
+	}
+	if res := all["next"]; res.Attempts != 0 || res.Err == nil || next.tries() != 0 {
+		t.Errorf("task after the fatal error result = %+v, run %d times", res, next.tries())
+	}
+	if p.Aborted() != denied || p.Err() != denied {
+		t.Errorf("Aborted = %v, Err = %v, want %v", p.Aborted(), p.Err(), denied)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPool(ctx, 1)
+	p.Retry = fastRetry
+	timeout := awserr.New("RequestError", "send request failed", nil)
+	inFlight := &fakeTask{name: "in flight", errs: []error{timeout}, started: make(chan string), release: make(chan struct{})}
+	if !p.Submit(inFlight) {
+		t.Fatal("task dropped before the cancellation")
+	}
+	<-inFlight.started
+	cancel()
+	if p.Submit(&fakeTask{name: "late"}) {
+		t.Error("task submitted after the cancellation")
+	}
+	if !p.Interrupted() {
+		t.Error("pool not interrupted")
+	}
+	close(inFlight.release)
+	p.Close()
+	all := results(p)
+	if _, ok := all["late"]; ok {
+		t.Error("late task run")
+	}
+	// the transient error of a task interrupted is not retried
+	if res := all["in flight"]; res.Attempts != 1 || res.Err != timeout || inFlight.tries() != 1 {
+		t.Errorf("in flight task result = %+v, run %d times", res, inFlight.tries())
+	}
+	if err := p.Err(); err != errInterrupted {
+		t.Errorf("Err = %v, want %v", err, errInterrupted)
+	}
+}
+
+func TestPoolCancelBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewPool(ctx, 1)
+	p.Retry = RetryPolicy{Attempts: 3, Backoff: time.Hour, MaxBackoff: time.Hour}
+	journal, err := NewJournal(t.TempDir(), RunSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if err := journal.Add("waiting", "waiting"); err != nil {
+		t.Fatal(err)
+	}
+	p.Journal = journal
+	throttled := awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "")
+	task := &fakeTask{name: "waiting", errs: []error{throttled}, started: make(chan string), release: make(chan struct{})}
+	if !p.Submit(task) {
+		t.Fatal("task dropped")
+	}
+	<-task.started
+	close(task.release)
+	// let the attempt fail and the task wait before its next one
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	p.Close()
+	done := make(chan map[string]Result)
+	go func() { done <- results(p) }()
+	select {
+	case all := <-done:
+		if res := all["waiting"]; res.Attempts != 1 || res.Err != errInterrupted {
+			t.Errorf("result = %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("task still waiting to be tried again after the cancellation")
+	}
+	if counts := journal.Counts(); counts[StatusInterrupted] != 1 {
+		t.Errorf("journal counts %v, want the task interrupted", counts)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{Attempts: 10, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{70, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if d := policy.delay(tt.attempt); d < 0 || d >= tt.max {
+				t.Errorf("delay(%d) = %s, want below %s", tt.attempt, d, tt.max)
+			}
+		}
+	}
+	if d := (RetryPolicy{}).delay(1); d != 0 {
+		t.Errorf("delay with no backoff = %s", d)
+	}
+}
@@ -0,0 +1,393 @@
+package job
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+	"github.com/pkg/errors"
+)
+
+// File states recorded in a Journal.
+const (
+	StatusPending     = "pending"
+	StatusUploading   = "uploading"
+	StatusDone        = "done"
+	StatusFailed      = "failed"
+	StatusInterrupted = "interrupted"
+)
+
+const runIDFormat = "20060102T150405Z"
+
+// Kinds of runs recorded in a Journal. A sync run uploads local files to
+// keys, a restore run downloads keys to local files and a copy run copies
+// keys to other keys.
+const (
+	RunSync    = "sync"
+	RunRestore = "restore"
+	RunCopy    = "copy"
+)
+
+// JournalEntry is the last known state of one file of a run. The first
+// line of a journal is an entry with only Kind set, the kind of its run.
+type JournalEntry struct {
+	Kind     string    `json:"kind,omitempty"`
+	Src      string    `json:"src"`
+	Dst      string    `json:"dst"`
+	Batch    string    `json:"batch,omitempty"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Class    string    `json:"class,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+}
+
+// Journal is the on-disk record of a sync run. Every state change is
+// appended as a JSON line, so the file survives a crash at any point and
+// replaying it gives the latest state of each file.
+type Journal struct {
+	ID   string
+	Path string
+	// Kind is the kind of the run, empty for the sync runs recorded before
+	// journals had one.
+	Kind string
+
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]*JournalEntry
+	order   []string
+
+	// files and bytes transferred by this process
+	transferred int
+	bytes       int64
+}
+
+func runsDir(stateDir string) string {
+	return filepath.Join(stateDir, "runs")
+}
+
+// NewJournal starts the journal of a new run of kind under stateDir. A run
+// started in the same second as an earlier one gets a numbered id.
+func NewJournal(stateDir, kind string) (*Journal, error) {
+	if err := os.MkdirAll(runsDir(stateDir), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	base := time.Now().UTC().Format(runIDFormat)
+	id := base
+	for n := 2; ; n++ {
+		path := filepath.Join(runsDir(stateDir), id+".jsonl")
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			j, err := openJournal(stateDir, id)
+			if err != nil {
+				return nil, err
+			}
+			j.Kind = kind
+			if err := j.write(&JournalEntry{Kind: kind}); err != nil {
+				j.Close()
+				return nil, err
+			}
+			return j, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.WithStack(err)
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// OpenJournal reopens the journal of run id and replays it.
+func OpenJournal(stateDir, id string) (*Journal, error) {
+	path := filepath.Join(runsDir(stateDir), id+".jsonl")
+	if _, err := os.Stat(path); err != nil {
+		return nil, errors.Wrapf(err, "run %s", id)
+	}
+	return openJournal(stateDir, id)
+}
+
+// runIDs returns the ids of the runs under stateDir in the order they
+// were started.
+func runIDs(stateDir string) ([]string, error) {
+	files, err := ioutil.ReadDir(runsDir(stateDir))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var ids []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".jsonl") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".jsonl"))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		ti, ni := runOrder(ids[i])
+		tj, nj := runOrder(ids[j])
+		return ti < tj || ti == tj && ni < nj
+	})
+	return ids, nil
+}
+
+// runOrder splits a run id into the second the run was started and its
+// number among the runs started in that second.
+func runOrder(id string) (string, int) {
+	if i := strings.LastIndex(id, "-"); i >= 0 {
+		if n, err := strconv.Atoi(id[i+1:]); err == nil {
+			return id[:i], n
+		}
+	}
+	return id, 1
+}
+
+// LatestRun returns the id of the most recent run of kind under stateDir.
+func LatestRun(stateDir, kind string) (string, error) {
+	ids, err := runIDs(stateDir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if runKind(filepath.Join(runsDir(stateDir), ids[i]+".jsonl")) == kind {
+			return ids[i], nil
+		}
+	}
+	return "", fmt.Errorf("no %s runs found in %s", kind, runsDir(stateDir))
+}
+
+// runKind returns the kind of run recorded in the journal at path, sync
+// for the journals recorded before runs had a kind.
+func runKind(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	entry := &JournalEntry{}
+	if scanner.Scan() && json.Unmarshal(scanner.Bytes(), entry) == nil && entry.Kind != "" {
+		return entry.Kind
+	}
+	return RunSync
+}
+
+func openJournal(stateDir, id string) (*Journal, error) {
+	if err := os.MkdirAll(runsDir(stateDir), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	j := &Journal{
+		ID:      id,
+		Path:    filepath.Join(runsDir(stateDir), id+".jsonl"),
+		entries: make(map[string]*JournalEntry),
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(j.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	j.file = file
+	return j, nil
+}
+
+func (j *Journal) replay() error {
+	file, err := os.Open(j.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// a torn last line from a crash, everything before it is valid
+			break
+		}
+		if entry.Kind != "" {
+			j.Kind = entry.Kind
+			continue
+		}
+		if _, ok := j.entries[entry.Src]; !ok {
+			j.order = append(j.order, entry.Src)
+		}
+		j.entries[entry.Src] = entry
+	}
+	return errors.WithStack(scanner.Err())
+}
+
+func (j *Journal) write(entry *JournalEntry) error {
+	entry.Time = time.Now().UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = j.file.Write(append(data, '\n'))
+	return errors.WithStack(err)
+}
+
+func (j *Journal) update(src string, fn func(e *JournalEntry)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry, ok := j.entries[src]
+	if !ok {
+		entry = &JournalEntry{Src: src}
+		j.entries[src] = entry
+		j.order = append(j.order, src)
+	}
+	fn(entry)
+	return j.write(entry)
+}
+
+// Add records src as pending upload to dst.
+func (j *Journal) Add(src, dst string) error {
+	return j.update(src, func(e *JournalEntry) {
+		e.Dst = dst
+		e.Status = StatusPending
+	})
+}
+
+// Batched records that src is uploaded as part of the tar object batch.
+func (j *Journal) Batched(src, batch string) error {
+	return j.update(src, func(e *JournalEntry) {
+		e.Batch = batch
+	})
+}
+
+// Batches returns the highest number of the batches recorded in j, 0 when
+// there is none.
+func (j *Journal) Batches() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	max := 0
+	for _, e := range j.entries {
+		if n := batchNumber(e.Batch); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// BatchedFile is a file a sync run uploaded in a tar batch, which the
+// device only extracts to an object of its own on import.
+type BatchedFile struct {
+	Src   string
+	Key   string
+	Batch string
+	Size  int64
+	// Time is when the batch was stored.
+	Time time.Time
+}
+
+// BatchedFiles replays the journals of the sync runs under stateDir and
+// returns by key the files uploaded in batches, as the latest run that
+// batched each one recorded it.
+func BatchedFiles(stateDir string) (map[string]*BatchedFile, error) {
+	batched := make(map[string]*BatchedFile)
+	ids, err := runIDs(stateDir)
+	if os.IsNotExist(errors.Cause(err)) {
+		return batched, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		j := &Journal{Path: filepath.Join(runsDir(stateDir), id+".jsonl"), entries: make(map[string]*JournalEntry)}
+		if err := j.replay(); err != nil {
+			return nil, err
+		}
+		if j.Kind != "" && j.Kind != RunSync {
+			continue
+		}
+		for _, src := range j.order {
+			e := j.entries[src]
+			if e.Status == StatusDone && e.Batch != "" {
+				batched[e.Dst] = &BatchedFile{Src: e.Src, Key: e.Dst, Batch: e.Batch, Size: e.Size, Time: e.Time}
+			}
+		}
+	}
+	return batched, nil
+}
+
+// Uploading records a new upload attempt of src.
+func (j *Journal) Uploading(src string) error {
+	return j.update(src, func(e *JournalEntry) {
+		e.Status = StatusUploading
+		e.Attempts++
+	})
+}
+
+// Done records src as uploaded, with size bytes sent.
+func (j *Journal) Done(src string, size int64) error {
+	return j.update(src, func(e *JournalEntry) {
+		e.Status = StatusDone
+		e.Error = ""
+		e.Class = ""
+		e.Size = size
+		j.transferred++
+		j.bytes += size
+	})
+}
+
+// Failed records the error that stopped the upload of src and its class.
+func (j *Journal) Failed(src string, err error) error {
+	return j.update(src, func(e *JournalEntry) {
+		e.Status = StatusFailed
+		e.Error = err.Error()
+		e.Class = string(cloud.Classify(err))
+	})
+}
+
+// Interrupted records that the upload of src was stopped with the run.
+func (j *Journal) Interrupted(src string) error {
+	return j.update(src, func(e *JournalEntry) {
+		e.Status = StatusInterrupted
+	})
+}
+
+// Unfinished returns the entries not uploaded yet, in the order they were
+// added. With failedOnly, only the failed ones are returned.
+func (j *Journal) Unfinished(failedOnly bool) []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var entries []JournalEntry
+	for _, src := range j.order {
+		e := j.entries[src]
+		if e.Status == StatusDone || (failedOnly && e.Status != StatusFailed) {
+			continue
+		}
+		entries = append(entries, *e)
+	}
+	return entries
+}
+
+// Counts returns how many files are in each state.
+func (j *Journal) Counts() map[string]int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	counts := make(map[string]int)
+	for _, e := range j.entries {
+		counts[e.Status]++
+	}
+	return counts
+}
+
+// Close flushes the journal to disk.
+func (j *Journal) Close() error {
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(j.file.Close())
+}
@@ -0,0 +1,158 @@
+package job
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func journalSrcs(entries []JournalEntry) []string {
+	var srcs []string
+	for _, e := range entries {
+		srcs = append(srcs, e.Src)
+	}
+	return srcs
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	j, err := NewJournal(dir, RunSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []func() error{
+		func() error { return j.Add("a", "ka") },
+		func() error { return j.Add("b", "kb") },
+		func() error { return j.Add("c", "kc") },
+		func() error { return j.Add("d", "kd") },
+		func() error { return j.Uploading("a") },
+		func() error { return j.Done("a", 10) },
+		func() error { return j.Uploading("b") },
+		func() error { return j.Failed("b", errors.New("no such file")) },
+		func() error { return j.Uploading("c") },
+		func() error { return j.Interrupted("c") },
+		func() error { return j.Uploading("b") },
+		func() error { return j.Failed("b", errors.New("still no such file")) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a line torn by a crash ends the journal
+	file, err := os.OpenFile(j.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"src":"a","status":"fai`)
+	file.Close()
+
+	replayed, err := OpenJournal(dir, j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	if replayed.Kind != RunSync {
+		t.Errorf("kind %q, want %q", replayed.Kind, RunSync)
+	}
+	tests := []struct {
+		failedOnly bool
+		want       []string
+	}{
+		{false, []string{"b", "c", "d"}},
+		{true, []string{"b"}},
+	}
+	for _, tt := range tests {
+		if got := journalSrcs(replayed.Unfinished(tt.failedOnly)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unfinished(%v) = %q, want %q", tt.failedOnly, got, tt.want)
+		}
+	}
+	b := replayed.Unfinished(true)[0]
+	if b.Dst != "kb" || b.Attempts != 2 || b.Error != "still no such file" || b.Class == "" {
+		t.Errorf("failed entry replayed as %+v", b)
+	}
+	want := map[string]int{StatusDone: 1, StatusFailed: 1, StatusInterrupted: 1, StatusPending: 1}
+	if counts := replayed.Counts(); !reflect.DeepEqual(counts, want) {
+		t.Errorf("Counts = %v, want %v", counts, want)
+	}
+}
+
+func TestNewJournalIDs(t *testing.T) {
+	dir := t.TempDir()
+	ids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		j, err := NewJournal(dir, RunSync)
+		if err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if ids[j.ID] {
+			t.Errorf("id %s given twice", j.ID)
+		}
+		ids[j.ID] = true
+	}
+}
+
+func TestLatestRun(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LatestRun(dir, RunSync); err == nil {
+		t.Error("latest run found with no runs")
+	}
+	if err := os.MkdirAll(runsDir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a journal recorded before runs had a kind is the one of a sync run
+	old := filepath.Join(runsDir(dir), "20200101T000000Z.jsonl")
+	if err := ioutil.WriteFile(old, []byte(`{"src":"a","dst":"a","status":"done"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restore, err := NewJournal(dir, RunRestore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore.Close()
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{RunSync, "20200101T000000Z"},
+		{RunRestore, restore.ID},
+	}
+	for _, tt := range tests {
+		id, err := LatestRun(dir, tt.kind)
+		if err != nil || id != tt.want {
+			t.Errorf("LatestRun(%s) = %s, %v, want %s", tt.kind, id, err, tt.want)
+		}
+	}
+	sync, err := NewJournal(dir, RunSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync.Close()
+	if id, _ := LatestRun(dir, RunSync); id != sync.ID {
+		t.Errorf("LatestRun after a new sync run = %s, want %s", id, sync.ID)
+	}
+}
+
+func TestRunIDs(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(runsDir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"20240501T100000Z", "20240501T100000Z-2", "20240501T100000Z-10", "20240501T100001Z"}
+	for _, id := range want {
+		if err := ioutil.WriteFile(filepath.Join(runsDir(dir), id+".jsonl"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := runIDs(dir)
+	if err != nil || !reflect.DeepEqual(ids, want) {
+		t.Errorf("runIDs = %q, %v, want %q", ids, err, want)
+	}
+}
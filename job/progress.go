@@ -0,0 +1,43 @@
+package job
+
+import (
+	"os"
+
+	"github.com/iandri/snowball/cloud"
+)
+
+// Monitor follows the bytes moved by each worker.
+type Monitor interface {
+	// Start tells that worker begins an attempt at name, of size bytes.
+	// The bytes counted by a previous attempt are taken back.
+	Start(worker int, name string, size int64)
+	// Add counts n bytes moved by worker, negative to take back.
+	Add(worker int, n int64)
+	// Finish tells that worker is done with its current file.
+	Finish(worker int)
+}
+
+type noMonitor struct{}
+
+func (noMonitor) Start(int, string, int64) {}
+func (noMonitor) Add(int, int64)           {}
+func (noMonitor) Finish(int)               {}
+
+// track starts an attempt of worker at task and returns the callback
+// counting its bytes.
+func (p *Pool) track(worker int, task Task) cloud.Progress {
+	p.Progress.Start(worker, task.Name(), task.Size())
+	return func(n int64) {
+		p.Progress.Add(worker, n)
+	}
+}
+
+// fileSize returns the size of src, 0 when it can't be read; the upload
+// reports the error.
+func fileSize(src string) int64 {
+	fi, err := os.Stat(src)
+	if err != nil || fi.IsDir() {
+		return 0
+	}
+	return fi.Size()
+}
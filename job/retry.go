@@ -0,0 +1,132 @@
+package job
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy is how many times a file is tried and how long to wait
+// between attempts: a random time up to Backoff doubled after every
+// attempt, capped at MaxBackoff.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetry is the policy of a new Pool.
+var DefaultRetry = RetryPolicy{Attempts: 3, Backoff: time.Second, MaxBackoff: time.Minute}
+
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	d := r.Backoff << uint(attempt-1)
+	if d > r.MaxBackoff || d <= 0 {
+		d = r.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+var errInterrupted = errors.New("run interrupted")
+
+// run tries task on worker until it succeeds, fails with an error that is
+// not transient or runs out of attempts, or the run is interrupted. Every
+// attempt and the outcome are recorded in the journal. A task dropped
+// before its first attempt is left as it was.
+func (p *Pool) run(worker int, task Task) Result {
+	res := Result{Task: task, Worker: worker}
+	srcs := task.Srcs()
+	for {
+		if err := p.Aborted(); err != nil {
+			res.Err = errors.Wrap(err, "run stopped")
+			p.record(srcs, nil, res.Err)
+			break
+		}
+		if p.Interrupted() {
+			res.Err = errInterrupted
+			if res.Attempts == 0 {
+				return res
+			}
+			p.recordInterrupted(srcs)
+			break
+		}
+		res.Attempts++
+		p.uploading(srcs)
+		sizes, err := task.Run(p.track(worker, task))
+		if err == nil {
+			res.Sizes = sizes
+			res.Err = nil
+			p.record(srcs, sizes, nil)
+			break
+		}
+		res.Err = err
+		class := cloud.Classify(err)
+		if class == cloud.ErrCanceled || class.Transient() && p.Interrupted() {
+			log.Printf("%s: interrupted: %v\n", task.Name(), err)
+			p.recordInterrupted(srcs)
+			break
+		}
+		if class.Fatal() {
+			log.Printf("%s: %s error, stopping the run: %v\n", task.Name(), class, err)
+			p.setAborted(err)
+		}
+		if !class.Transient() || res.Attempts >= p.Retry.Attempts {
+			log.Printf("%s: %s error after %d attempts: %v\n", task.Name(), class, res.Attempts, err)
+			p.record(srcs, nil, err)
+			break
+		}
+		delay := p.Retry.delay(res.Attempts)
+		log.Printf("%s: %s error, retrying in %s: %v\n", task.Name(), class, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-p.ctx.Done():
+			// recorded as interrupted on the next turn
+		}
+	}
+	p.Progress.Finish(worker)
+	return res
+}
+
+func (p *Pool) uploading(srcs []string) {
+	if p.Journal == nil {
+		return
+	}
+	for _, src := range srcs {
+		if err := p.Journal.Uploading(src); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (p *Pool) record(srcs []string, sizes []int64, err error) {
+	if p.Journal == nil {
+		return
+	}
+	for i, src := range srcs {
+		var jerr error
+		if err != nil {
+			jerr = p.Journal.Failed(src, err)
+		} else {
+			jerr = p.Journal.Done(src, sizes[i])
+		}
+		if jerr != nil {
+			log.Println(jerr)
+		}
+	}
+}
+
+func (p *Pool) recordInterrupted(srcs []string) {
+	if p.Journal == nil {
+		return
+	}
+	for _, src := range srcs {
+		if err := p.Journal.Interrupted(src); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/iandri/snowball/utils"
+	"github.com/pkg/errors"
+)
+
+// Summary is the outcome of a run: the files transferred by this process,
+// the ones skipped because already there, and the ones that failed.
+type Summary struct {
+	Run         string         `json:"run"`
+	Transferred int            `json:"transferred"`
+	Skipped     int            `json:"skipped"`
+	Failed      int            `json:"failed"`
+	Left        int            `json:"left,omitempty"`
+	Classes     map[string]int `json:"failed_classes,omitempty"`
+	Bytes       int64          `json:"bytes"`
+	Seconds     float64        `json:"seconds"`
+	Bandwidth   float64        `json:"bytes_per_second"`
+	Stopped     string         `json:"stopped,omitempty"`
+	Failures    []JournalEntry `json:"failures,omitempty"`
+	// Deleted and DeleteFailures are the objects the run deleted and
+	// failed to delete from the destination.
+	Deleted        int             `json:"deleted,omitempty"`
+	DeleteFailures []DeleteFailure `json:"delete_failures,omitempty"`
+}
+
+// DeleteFailure is an object a run failed to delete.
+type DeleteFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// Summary sums up the run of j, which took elapsed after skipping skipped
+// files and stopped early with stopped, if not nil. The files neither done
+// nor failed are left, when the run was interrupted.
+func (j *Journal) Summary(skipped int, elapsed time.Duration, stopped error) *Summary {
+	failures := j.Unfinished(true)
+	left := len(j.Unfinished(false)) - len(failures)
+	j.mu.Lock()
+	s := &Summary{
+		Run:         j.ID,
+		Transferred: j.transferred,
+		Skipped:     skipped,
+		Failed:      len(failures),
+		Left:        left,
+		Bytes:       j.bytes,
+		Seconds:     elapsed.Seconds(),
+		Failures:    failures,
+	}
+	j.mu.Unlock()
+	if s.Seconds > 0 {
+		s.Bandwidth = float64(s.Bytes) / s.Seconds
+	}
+	for _, f := range failures {
+		if s.Classes == nil {
+			s.Classes = make(map[string]int)
+		}
+		s.Classes[f.Class]++
+	}
+	if stopped != nil {
+		s.Stopped = stopped.Error()
+	}
+	return s
+}
+
+// Text returns the summary on one line, verb naming what was done to the
+// transferred files.
+func (s *Summary) Text(verb string) string {
+	text := fmt.Sprintf("%d %s, %d skipped, %d failed", s.Transferred, verb, s.Skipped, s.Failed)
+	if len(s.Classes) > 0 {
+		var classes []string
+		for class, n := range s.Classes {
+			classes = append(classes, fmt.Sprintf("%s: %d", class, n))
+		}
+		sort.Strings(classes)
+		text += " (" + strings.Join(classes, ", ") + ")"
+	}
+	if s.Left > 0 {
+		text += fmt.Sprintf(", %d left", s.Left)
+	}
+	if s.Deleted > 0 || len(s.DeleteFailures) > 0 {
+		text += fmt.Sprintf(", %d deleted, %d not deleted", s.Deleted, len(s.DeleteFailures))
+	}
+	return fmt.Sprintf("%s, %s in %s, %s/s", text, humanize.Bytes(uint64(s.Bytes)),
+		utils.HumanizeDuration(time.Duration(s.Seconds*float64(time.Second))), humanize.Bytes(uint64(s.Bandwidth)))
+}
+
+// WriteJSON writes the summary as JSON to path.
+func (s *Summary) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(path, data, 0644))
+}
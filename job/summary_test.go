@@ -0,0 +1,97 @@
+package job
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iandri/snowball/cloud"
+)
+
+func TestJournalSummary(t *testing.T) {
+	j, err := NewJournal(t.TempDir(), RunSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	steps := []func() error{
+		func() error { return j.Add("a", "a") },
+		func() error { return j.Add("b", "b") },
+		func() error { return j.Add("c", "c") },
+		func() error { return j.Add("d", "d") },
+		func() error { return j.Done("a", 1000) },
+		func() error { return j.Failed("b", &cloud.ChecksumError{Key: "b"}) },
+		func() error { return j.Failed("c", errors.New("no such file")) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := j.Summary(5, 2*time.Second, errInterrupted)
+	if s.Run != j.ID || s.Transferred != 1 || s.Skipped != 5 || s.Failed != 2 || s.Left != 1 || s.Bytes != 1000 {
+		t.Errorf("summary %+v", s)
+	}
+	if s.Bandwidth != 500 || s.Stopped != errInterrupted.Error() {
+		t.Errorf("bandwidth %v, stopped %q", s.Bandwidth, s.Stopped)
+	}
+	want := map[string]int{string(cloud.ErrChecksum): 1, string(cloud.ErrOther): 1}
+	if !reflect.DeepEqual(s.Classes, want) {
+		t.Errorf("classes %v, want %v", s.Classes, want)
+	}
+	if srcs := journalSrcs(s.Failures); !reflect.DeepEqual(srcs, []string{"b", "c"}) {
+		t.Errorf("failures %q", srcs)
+	}
+}
+
+func TestSummaryText(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary Summary
+		want    string
+	}{
+		{"done", Summary{Transferred: 3, Skipped: 1, Bytes: 3000, Seconds: 2, Bandwidth: 1500},
+			"3 uploaded, 1 skipped, 0 failed, 3.0 kB in 2 seconds, 1.5 kB/s"},
+		{"failed", Summary{Transferred: 1, Failed: 3, Classes: map[string]int{"network": 1, "checksum": 2}},
+			"1 uploaded, 0 skipped, 3 failed (checksum: 2, network: 1), 0 B in 0 nanoseconds, 0 B/s"},
+		{"interrupted", Summary{Left: 4}, "0 uploaded, 0 skipped, 0 failed, 4 left, 0 B in 0 nanoseconds, 0 B/s"},
+		{"deleted", Summary{Deleted: 2, DeleteFailures: []DeleteFailure{{Key: "a", Error: "denied"}}},
+			"0 uploaded, 0 skipped, 0 failed, 2 deleted, 1 not deleted, 0 B in 0 nanoseconds, 0 B/s"},
+	}
+	for _, tt := range tests {
+		if got := tt.summary.Text("uploaded"); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSummaryWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	s := &Summary{Run: "20240501T100000Z", Transferred: 1, Failed: 1, Classes: map[string]int{"network": 1},
+		Failures: []JournalEntry{{Src: "b", Dst: "b", Status: StatusFailed, Error: "timeout"}}}
+	if err := s.WriteJSON(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fields left empty are not written
+	for _, field := range []string{`"left"`, `"stopped"`, `"deleted"`} {
+		if strings.Contains(string(data), field) {
+			t.Errorf("report holds %s: %s", field, data)
+		}
+	}
+	var read Summary
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&read, s) {
+		t.Errorf("report read back as %+v, want %+v", read, *s)
+	}
+}
@@ -0,0 +1,29 @@
+package job
+
+import (
+	"github.com/iandri/snowball/cloud"
+)
+
+// Upload uploads the file Src to the key Dst.
+type Upload struct {
+	Transfer
+	Src string
+	Dst string
+}
+
+func (t *Upload) Name() string {
+	return t.Src
+}
+
+func (t *Upload) Srcs() []string {
+	return []string{t.Src}
+}
+
+func (t *Upload) Size() int64 {
+	return fileSize(t.Src)
+}
+
+func (t *Upload) Run(progress cloud.Progress) ([]int64, error) {
+	result, err := t.Engine.Upload(t.Bucket, t.Src, t.Dst, t.options(progress))
+	return []int64{result.Size}, err
+}